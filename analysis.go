@@ -0,0 +1,426 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// UniqueTokens encodes data and returns the distinct token IDs it contains,
+// sorted in ascending order.
+func (t *Tokenizer) UniqueTokens(data []byte) ([]int, error) {
+	tokens, err := t.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(tokens)
+	n := 0
+	for i, v := range tokens {
+		if i == 0 || v != tokens[n-1] {
+			tokens[n] = v
+			n++
+		}
+	}
+	return tokens[:n], nil
+}
+
+// SplitAtTokens splits text into chunks of tokensPerChunk tokens each, except
+// for the last chunk, which may be shorter. Chunks only end at token
+// boundaries that are also character boundaries, so a chunk may hold extra
+// tokens when a character is split across several tokens. Concatenating the
+// chunks yields text. SplitAtTokens returns ErrNonPositiveCount if
+// tokensPerChunk is not positive.
+func (t *Tokenizer) SplitAtTokens(text string, tokensPerChunk int) ([]string, error) {
+	if tokensPerChunk <= 0 {
+		return nil, ErrNonPositiveCount
+	}
+
+	// The pieces, unlike the tokens themselves, give the span of input that
+	// each token covers, even for unknown and fallback tokens.
+	pieces, err := t.EncodePieces([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []string
+	start, end, n := 0, 0, 0
+	for _, piece := range pieces {
+		end += len(piece)
+		n++
+		if n >= tokensPerChunk && (end == len(text) || utf8.RuneStart(text[end])) {
+			chunks = append(chunks, text[start:end])
+			start, n = end, 0
+		}
+	}
+	if start < len(text) {
+		chunks = append(chunks, text[start:])
+	}
+	return chunks, nil
+}
+
+// VocabHash returns a hex-encoded SHA-256 digest of the Tokenizer's
+// vocabulary. The digest covers every ID and its token, in ID order, so
+// tokenizers with the same vocabulary have the same hash no matter how it
+// was loaded.
+func (t *Tokenizer) VocabHash() string {
+	return t.VocabHashWith(sha256.New())
+}
+
+// VocabHashWith is like VocabHash, but computes the digest with h, which is
+// reset first. A fast non-cryptographic hash such as FNV-1a suits quick
+// equality checks, while VocabHash's SHA-256 guards against deliberate
+// collisions. Digests from different hash functions cannot be compared.
+func (t *Tokenizer) VocabHashWith(h hash.Hash) string {
+	ids := make([]int, 0, len(t.i2t))
+	for id := range t.i2t {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	h.Reset()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%d:%x\n", id, t.i2t[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AppendTokenDelta returns how many more tokens prefix+suffix encodes to
+// than prefix alone. The result accounts for tokens at the end of prefix
+// merging with the start of suffix, so it may be smaller than the number of
+// tokens suffix encodes to on its own, and can even be negative.
+//
+// Only the end of prefix that could be affected by such a merge is
+// re-encoded together with suffix.
+func (t *Tokenizer) AppendTokenDelta(prefix, suffix string) (delta int, err error) {
+	if prefix == "" {
+		tokens, err := t.EncodeString(suffix)
+		return len(tokens), err
+	}
+
+	data := t.prepareInput([]byte(prefix))
+	if t.normNewlines && strings.HasSuffix(prefix, "\r") && strings.HasPrefix(suffix, "\n") {
+		// The CR at the end of prefix has already become the LF.
+		suffix = suffix[1:]
+	}
+	suffixData := t.normalizeNewlines([]byte(suffix))
+
+	// Find the first token in prefix whose match could extend into suffix,
+	// i.e. the first token start from which the rest of prefix could still
+	// begin a token. Tokens before it are unaffected by suffix.
+	var scratch [utf8.UTFMax]int
+	n, count, boundary, before := 0, 0, -1, 0
+	for n < len(data) {
+		if boundary == -1 && t.couldBeginToken(data[n:]) {
+			boundary, before = n, count
+		}
+
+		ids, n2, ok := t.matchNext(scratch[:0], data, n)
+		if !ok {
+			return 0, ErrCannotTokenize
+		}
+		count += len(ids)
+		n = n2
+	}
+	if boundary == -1 {
+		boundary, before = len(data), count
+	}
+
+	tail := make([]byte, 0, len(data)-boundary+len(suffixData))
+	tail = append(append(tail, data[boundary:]...), suffixData...)
+	tokens, err := t.encodeAppend(nil, tail)
+	if err != nil {
+		return 0, err
+	}
+	return before + len(tokens) - count, nil
+}
+
+// DiffEncoding compares two token slices and returns the index of the first
+// token at which they differ. If one slice is a prefix of the other, the
+// index is the length of the shorter one. If they are equal, DiffEncoding
+// returns -1 and true.
+func DiffEncoding(a, b []int) (index int, equal bool) {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i, false
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b)), false
+	}
+	return -1, true
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// HashTokens returns a 64-bit FNV-1a hash of a token sequence, computed over
+// each ID as 8 little-endian bytes. It is meant for cheaply grouping
+// documents that encode to the same tokens, such as when deduplicating a
+// corpus, and is not cryptographically secure.
+func HashTokens(tokens []int) uint64 {
+	h := uint64(fnvOffset64)
+	for _, v := range tokens {
+		h = hashToken(h, v)
+	}
+	return h
+}
+
+// hashToken adds a token ID to the FNV-1a hash h.
+func hashToken(h uint64, v int) uint64 {
+	x := uint64(v)
+	for i := 0; i < 8; i++ {
+		h ^= x & 0xff
+		h *= fnvPrime64
+		x >>= 8
+	}
+	return h
+}
+
+// EncodeWithHash is like Encode, but also returns HashTokens of the tokens,
+// which is updated as each token is emitted rather than in a second pass over
+// them. If encoding fails, the hash covers the tokens produced so far.
+func (t *Tokenizer) EncodeWithHash(data []byte) (tokens []int, hash uint64, err error) {
+	hash = fnvOffset64
+	if err := t.checkInput(data); err != nil {
+		return nil, hash, err
+	}
+
+	tokens = make([]int, 0, 32)
+	err = t.EncodeFunc(data, func(id int) error {
+		tokens = append(tokens, id)
+		hash = hashToken(hash, id)
+		return nil
+	})
+	return tokens, hash, err
+}
+
+// TokenEditDistance encodes a and b and returns the Levenshtein distance
+// between their token sequences, that is, the number of token insertions,
+// deletions and substitutions needed to turn one into the other. Because a
+// small edit to the text can shift token boundaries around it, the distance
+// may be much larger than the number of characters changed.
+func (t *Tokenizer) TokenEditDistance(a, b string) (int, error) {
+	ta, err := t.EncodeString(a)
+	if err != nil {
+		return 0, err
+	}
+	tb, err := t.EncodeString(b)
+	if err != nil {
+		return 0, err
+	}
+
+	prev := make([]int, len(tb)+1)
+	cur := make([]int, len(tb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range ta {
+		cur[0] = i + 1
+		for j := range tb {
+			cost := 1
+			if ta[i] == tb[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(tb)], nil
+}
+
+// CommonTokenPrefixLen encodes a and b and returns the number of leading
+// tokens their encodings share, which is how much of a cached prompt, such
+// as its key-value cache in an inference server, can be reused for another.
+// If a and b are identical, it is the length of their encoding. Note that a
+// shared text prefix does not always give the same number of shared tokens,
+// since the token at the point where the texts diverge may differ.
+func (t *Tokenizer) CommonTokenPrefixLen(a, b string) (int, error) {
+	ta, err := t.EncodeString(a)
+	if err != nil {
+		return 0, err
+	}
+	tb, err := t.EncodeString(b)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(ta) && n < len(tb) && ta[n] == tb[n] {
+		n++
+	}
+	return n, nil
+}
+
+// FindTokenPositions encodes data and returns the indices in the resulting
+// token stream at which the token id occurs.
+func (t *Tokenizer) FindTokenPositions(data []byte, id int) ([]int, error) {
+	var positions []int
+	i := 0
+	err := t.EncodeFunc(data, func(v int) error {
+		if v == id {
+			positions = append(positions, i)
+		}
+		i++
+		return nil
+	})
+	return positions, err
+}
+
+// TokenFrequencies encodes data and returns the number of times each token
+// ID occurs in the result.
+func (t *Tokenizer) TokenFrequencies(data []byte) (map[int]int64, error) {
+	freqs := make(map[int]int64)
+	err := t.EncodeFunc(data, func(id int) error {
+		freqs[id]++
+		return nil
+	})
+	return freqs, err
+}
+
+// Entropy returns the Shannon entropy, in bits per token, of the token
+// distribution given by freqs, which maps token IDs to the number of times
+// they were observed, as returned by TokenFrequencies. Lower values mean the
+// tokens are more predictable. Non-positive counts are ignored, and an empty
+// distribution has an entropy of zero.
+func Entropy(freqs map[int]int64) float64 {
+	var total float64
+	for _, n := range freqs {
+		if n > 0 {
+			total += float64(n)
+		}
+	}
+
+	var h float64
+	for _, n := range freqs {
+		if n > 0 {
+			p := float64(n) / total
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// TokenDensity encodes data and returns, for each byte of data, the length
+// in bytes of the token covering it, for visualizing token boundaries. Like
+// EncodePieces, it adds no prefix space, so every byte of data is covered.
+func (t *Tokenizer) TokenDensity(data []byte) ([]int, error) {
+	pieces, err := t.EncodePieces(data)
+	density := make([]int, 0, len(data))
+	for _, piece := range pieces {
+		for range piece {
+			density = append(density, len(piece))
+		}
+	}
+	return density, err
+}
+
+// CoverageStats encodes data and counts the tokens that cover more than one
+// byte of it, which are real vocabulary hits, and those that cover a single
+// byte, as byte-level fallbacks do. A low share of multi-byte tokens means
+// the vocabulary fits the text poorly. Like EncodePieces, it adds no prefix
+// space.
+func (t *Tokenizer) CoverageStats(data []byte) (multiByte, singleByte int, err error) {
+	pieces, err := t.EncodePieces(data)
+	for _, piece := range pieces {
+		if len(piece) > 1 {
+			multiByte++
+		} else {
+			singleByte++
+		}
+	}
+	return multiByte, singleByte, err
+}
+
+// LineTokenCounts encodes text in one pass and returns the number of tokens
+// on each of its lines, as split by strings.Split(text, "\n"), for finding
+// the lines that use the most of a context window. A token is counted on the
+// line where it starts, so a token that spans a line break, such as ".\n" or
+// "\n\n", counts towards the earlier line, and the counts add up to the
+// number of tokens in text. Like EncodePieces, it adds no prefix space.
+func (t *Tokenizer) LineTokenCounts(text string) ([]int, error) {
+	pieces, err := t.EncodePieces([]byte(text))
+	counts := make([]int, strings.Count(text, "\n")+1)
+	line := 0
+	for _, piece := range pieces {
+		counts[line]++
+		line += bytes.Count(piece, []byte{'\n'})
+	}
+	return counts, err
+}
+
+// endsSentence reports whether a token ends with sentence-ending
+// punctuation, possibly followed by whitespace, and whether the
+// punctuation needs to be followed by whitespace to end a sentence.
+func endsSentence(token string) (ends, needsSpace bool) {
+	trimmed := strings.TrimRightFunc(token, unicode.IsSpace)
+	r, _ := utf8.DecodeLastRuneInString(trimmed)
+	switch r {
+	case '.', '!', '?':
+		return true, len(trimmed) == len(token)
+	case '。', '！', '？':
+		return true, false
+	}
+	return false, false
+}
+
+// SplitSentences splits tokens into chunks that each end at the end of a
+// sentence, except for the last chunk, which holds whatever follows the last
+// sentence end. A sentence ends after a token ending in '.', '!' or '?' that
+// is followed by whitespace, either within the token itself, as in ". ", or
+// at the start of the next token, or after a token ending in one of their
+// full-width forms. Whitespace-only tokens that follow the end of a sentence
+// are kept with it, while other whitespace, such as the space in " How",
+// starts the next chunk. This keeps decimal numbers such as "3.14" together,
+// but like any such heuristic it also splits after abbreviations. It returns
+// ErrUnknownToken if tokens contains an unknown ID.
+func (t *Tokenizer) SplitSentences(tokens []int) ([][]int, error) {
+	var chunks [][]int
+	start := 0
+	for i, v := range tokens {
+		token, ok := t.vocabToken(v)
+		if !ok {
+			return nil, ErrUnknownToken
+		}
+
+		ends, needsSpace := endsSentence(token)
+		if ends && needsSpace && i+1 < len(tokens) {
+			next, ok := t.vocabToken(tokens[i+1])
+			if !ok {
+				return nil, ErrUnknownToken
+			}
+			r, _ := utf8.DecodeRuneInString(next)
+			ends = unicode.IsSpace(r)
+		}
+		if !ends {
+			continue
+		}
+
+		// Keep whitespace-only tokens, such as a paragraph break, with the
+		// sentence they follow.
+		j := i + 1
+		for ; j < len(tokens); j++ {
+			next, ok := t.vocabToken(tokens[j])
+			if !ok || strings.TrimSpace(next) != "" {
+				break
+			}
+		}
+		chunks = append(chunks, tokens[start:j:j])
+		start = j
+	}
+	if start < len(tokens) {
+		chunks = append(chunks, tokens[start:])
+	}
+	return chunks, nil
+}
@@ -0,0 +1,430 @@
+package rwkvtkn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"hash/fnv"
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestUniqueTokens tests that repeated tokens are collapsed.
+func TestUniqueTokens(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("b", 2)
+	tkn.AddTokenString("ab", 3)
+
+	s, i := "babab", []int{2, 3}
+	x, err := tkn.UniqueTokens([]byte(s))
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`UniqueTokens(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+}
+
+// TestSplitAtTokens tests chunking text, including a character that is
+// split across byte tokens.
+func TestSplitAtTokens(t *testing.T) {
+	tkn := NewTokenizer()
+	for c := 0; c < 256; c++ {
+		tkn.AddToken([]byte{byte(c)}, c+1)
+	}
+	tkn.AddTokenString("ab", 257)
+
+	s := "ababa世b"
+	x, err := tkn.SplitAtTokens(s, 2)
+	y := []string{"abab", "a世", "b"}
+	if len(x) != len(y) || err != nil {
+		t.Fatalf(`SplitAtTokens(%q, 2) = %q, %v, want equal to %q`, s, x, err, y)
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			t.Fatalf(`SplitAtTokens(%q, 2) = %q, want equal to %q`, s, x, y)
+		}
+	}
+
+	if _, err := tkn.SplitAtTokens(s, 0); err != ErrNonPositiveCount {
+		t.Fatalf(`SplitAtTokens(%q, 0) = _, %v, want %v`, s, err, ErrNonPositiveCount)
+	}
+}
+
+// TestSplitAtTokensFallback tests chunking text with tokens that cover a
+// different number of bytes than their own token strings.
+func TestSplitAtTokensFallback(t *testing.T) {
+	unk := NewTokenizer()
+	unk.AddTokenString("<unk>", 0)
+	unk.AddTokenString("a", 1)
+	unk.SetEncodeUnknownID(0)
+
+	// An unknown ID that is not in the vocabulary covers a byte too.
+	bare := NewTokenizer()
+	bare.AddTokenString("a", 1)
+	bare.AddTokenString("yza", 2)
+	bare.SetEncodeUnknownID(99)
+
+	fallback := NewTokenizer()
+	fallback.AddTokenString("hello", 0)
+	layered := NewTokenizer()
+	layered.AddTokenString("a", 0)
+	layered.SetFallback(fallback)
+
+	for _, c := range []struct {
+		tkn  *Tokenizer
+		text string
+		want []string
+	}{
+		{unk, "a\xffa", []string{"a", "\xff", "a"}},
+		{bare, "a\xe4\xb8\x96xyza", []string{"a", "\xe4\xb8\x96", "x", "yza"}},
+		{layered, "ahelloa", []string{"a", "hello", "a"}},
+	} {
+		x, err := c.tkn.SplitAtTokens(c.text, 1)
+		if strings.Join(x, "|") != strings.Join(c.want, "|") || err != nil {
+			t.Fatalf(`SplitAtTokens(%q, 1) = %q, %v, want equal to %q`, c.text, x, err, c.want)
+		}
+	}
+}
+
+// TestVocabHash tests that VocabHash depends only on the vocabulary.
+func TestVocabHash(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	var b bytes.Buffer
+	if err := tkn.WriteBinary(&b); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := NewTokenizerFromBinary(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload, err := NewTokenizerFromReader(bytes.NewReader(WorldVocabBytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := tkn.VocabHash()
+	if x, y := clone.VocabHash(), reload.VocabHash(); x != h || y != h {
+		t.Fatalf(`VocabHash() = %s (clone), %s (reload), want equal to %s`, x, y, h)
+	}
+
+	reload.AddTokenString("Hello!", 33155)
+	if x := reload.VocabHash(); x == h {
+		t.Fatalf(`VocabHash() = %s after changing a token, want different`, x)
+	}
+
+	a, c := NewTokenizer(), NewTokenizer()
+	a.AddTokenString("a", 1)
+	a.AddTokenString("b", 2)
+	c.AddTokenString("b", 2)
+	c.AddTokenString("a", 1)
+	if x, y := a.VocabHash(), c.VocabHash(); x != y {
+		t.Fatalf(`VocabHash() = %s, %s for different insertion orders, want equal`, x, y)
+	}
+}
+
+// TestVocabHashWith tests that each hash function gives the same digest for
+// the same vocabulary, reusing the hash between calls.
+func TestVocabHashWith(t *testing.T) {
+	a, b, c := NewTokenizer(), NewTokenizer(), NewTokenizer()
+	for id, token := range []string{"a", "b", "ab"} {
+		a.AddTokenString(token, id)
+		b.AddTokenString(token, id)
+		c.AddTokenString(token, id+1)
+	}
+
+	if x, y := a.VocabHash(), a.VocabHashWith(sha256.New()); x != y {
+		t.Fatalf(`VocabHashWith(sha256.New()) = %s, want equal to VocabHash() = %s`, y, x)
+	}
+
+	for name, h := range map[string]hash.Hash{"fnv": fnv.New64a(), "sha256": sha256.New()} {
+		x, y, z := a.VocabHashWith(h), b.VocabHashWith(h), c.VocabHashWith(h)
+		if x != y || x == z {
+			t.Fatalf(`VocabHashWith(%s) = %s, %s, %s, want the first two equal and the last different`, name, x, y, z)
+		}
+	}
+	if x, y := a.VocabHashWith(fnv.New64a()), a.VocabHash(); len(x) != 16 || x == y {
+		t.Fatalf(`VocabHashWith(fnv.New64a()) = %s, want a 64-bit digest different from %s`, x, y)
+	}
+}
+
+// TestAppendTokenDelta tests that the delta matches re-encoding the whole
+// text, including when the boundary tokens merge.
+func TestAppendTokenDelta(t *testing.T) {
+	tkn := NewTokenizer()
+	for _, token := range []string{"a", "b", "c", "d", "abc", "cd"} {
+		tkn.AddTokenString(token, len(tkn.i2t)+1)
+	}
+	world := newWorldTokenizer(t)
+
+	for _, tc := range []struct {
+		tkn            *Tokenizer
+		prefix, suffix string
+	}{
+		{tkn, "ab", "c"},
+		{tkn, "abc", "d"},
+		{tkn, "dab", "cd"},
+		{tkn, "", "abcd"},
+		{tkn, "abcd", ""},
+		{world, "Hello, wor", "ld!"},
+		{world, "Hello, world", "! こんにちは"},
+	} {
+		x, err := tc.tkn.AppendTokenDelta(tc.prefix, tc.suffix)
+		a, _ := tc.tkn.EncodeString(tc.prefix)
+		b, _ := tc.tkn.EncodeString(tc.prefix + tc.suffix)
+		if i := len(b) - len(a); x != i || err != nil {
+			t.Fatalf(`AppendTokenDelta(%q, %q) = %d, %v, want equal to %d`, tc.prefix, tc.suffix, x, err, i)
+		}
+	}
+}
+
+// TestDiffEncoding tests equal slices, a shorter prefix and a difference in
+// the middle.
+func TestDiffEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  []int
+		index int
+		equal bool
+	}{
+		{[]int{1, 2, 3}, []int{1, 2, 3}, -1, true},
+		{nil, []int{}, -1, true},
+		{[]int{1, 2}, []int{1, 2, 3}, 2, false},
+		{[]int{1, 2, 3}, []int{1}, 1, false},
+		{[]int{1, 2, 3}, []int{1, 4, 3}, 1, false},
+	} {
+		index, equal := DiffEncoding(tc.a, tc.b)
+		if index != tc.index || equal != tc.equal {
+			t.Fatalf(`DiffEncoding(%v, %v) = %d, %v, want equal to %d, %v`, tc.a, tc.b, index, equal, tc.index, tc.equal)
+		}
+	}
+}
+
+// TestEncodeWithHash tests that equal inputs hash the same and different
+// inputs hash differently.
+func TestEncodeWithHash(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	inputs := []string{"Hello, world!", "Hello, world?", "Hello,  world!", ""}
+	hashes := make(map[uint64]string)
+	for _, text := range inputs {
+		tokens, hash, err := tkn.EncodeWithHash([]byte(text))
+		if err != nil {
+			t.Fatalf(`EncodeWithHash(%q) = _, _, %v`, text, err)
+		}
+		if h := HashTokens(tokens); h != hash {
+			t.Fatalf(`EncodeWithHash(%q) = _, %x, _, want equal to %x`, text, hash, h)
+		}
+		if _, h2, _ := tkn.EncodeWithHash([]byte(text)); h2 != hash {
+			t.Fatalf(`EncodeWithHash(%q) = _, %x, _, want equal to %x`, text, h2, hash)
+		}
+		if other, ok := hashes[hash]; ok {
+			t.Fatalf(`EncodeWithHash(%q) = _, %x, _, same as for %q`, text, hash, other)
+		}
+		hashes[hash] = text
+	}
+
+	// The hash also covers document separator tokens.
+	tkn.SetDocumentSeparator(0, 0)
+	text := []byte("Hello\x00world")
+	want, _ := tkn.Encode(text)
+	if tokens, hash, err := tkn.EncodeWithHash(text); !intSliceEquals(tokens, want) || hash != HashTokens(want) || err != nil {
+		t.Fatalf(`EncodeWithHash(%q) = %v, %x, %v, want equal to %v, %x`, text, tokens, hash, err, want, HashTokens(want))
+	}
+
+	if h := HashTokens(nil); h != fnvOffset64 {
+		t.Fatalf(`HashTokens(nil) = %x, want equal to %x`, h, uint64(fnvOffset64))
+	}
+}
+
+// TestTokenEditDistance tests that inserting a single digit in front of a
+// number shifts every token boundary after it.
+func TestTokenEditDistance(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1234567890", "01234567890", 6},
+		{"Hello, world!", "Hello, world!", 0},
+		{"", "1234567890", 5},
+		{"Hello, world!", "Hello, world?", 1},
+	} {
+		if d, err := tkn.TokenEditDistance(c.a, c.b); d != c.want || err != nil {
+			t.Fatalf(`TokenEditDistance(%q, %q) = %d, %v, want equal to %d`, c.a, c.b, d, err, c.want)
+		}
+	}
+}
+
+// TestCommonTokenPrefixLen tests counting the leading tokens that two texts
+// share.
+func TestCommonTokenPrefixLen(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	system := "You are a helpful assistant.\n\nUser:"
+	prefix, _ := tkn.EncodeString(system)
+	full, _ := tkn.EncodeString(system + " Hello!")
+
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{system + " Hello!", system + " What is 2+2?", len(prefix)},
+		{system + " Hello!", system + " Hello!", len(full)},
+		// The space is matched together with the word after it.
+		{system + " Hello!", system + " ", len(prefix)},
+		{"", system, 0},
+		{"Hello", "Help", 0},
+	} {
+		if n, err := tkn.CommonTokenPrefixLen(c.a, c.b); n != c.want || err != nil {
+			t.Fatalf(`CommonTokenPrefixLen(%q, %q) = %d, %v, want equal to %d`, c.a, c.b, n, err, c.want)
+		}
+	}
+}
+
+// TestFindTokenPositions tests finding a token that occurs several times.
+func TestFindTokenPositions(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	text := []byte("Hello, world! Hello, world!")
+	tokens, _ := tkn.Encode(text)
+	id := tokens[1]
+
+	var want []int
+	for i, v := range tokens {
+		if v == id {
+			want = append(want, i)
+		}
+	}
+	if len(want) < 2 {
+		t.Fatalf(`Encode(%q) = %v, want token %d repeated`, text, tokens, id)
+	}
+
+	if positions, err := tkn.FindTokenPositions(text, id); !intSliceEquals(positions, want) || err != nil {
+		t.Fatalf(`FindTokenPositions(%q, %d) = %v, %v, want equal to %v`, text, id, positions, err, want)
+	}
+	if positions, err := tkn.FindTokenPositions(text, 0); len(positions) != 0 || err != nil {
+		t.Fatalf(`FindTokenPositions(%q, 0) = %v, %v, want equal to []`, text, positions, err)
+	}
+}
+
+// TestEntropy tests the entropy of known distributions and of counted
+// token frequencies.
+func TestEntropy(t *testing.T) {
+	for _, c := range []struct {
+		freqs map[int]int64
+		want  float64
+	}{
+		{map[int]int64{}, 0},
+		{map[int]int64{1: 5}, 0},
+		{map[int]int64{1: 3, 2: 3, 3: 3, 4: 3}, 2},
+		{map[int]int64{1: 7, 2: 7, 3: 7, 4: 7, 5: 7}, math.Log2(5)},
+		{map[int]int64{1: 1, 2: 1, 3: 2}, 1.5},
+		{map[int]int64{1: 4, 2: 4, 3: 0, 4: -1}, 1},
+	} {
+		if h := Entropy(c.freqs); math.Abs(h-c.want) > 1e-9 {
+			t.Fatalf(`Entropy(%v) = %v, want equal to %v`, c.freqs, h, c.want)
+		}
+	}
+
+	tkn := newWorldTokenizer(t)
+	text := []byte("Hello, world! Hello, world!")
+	freqs, err := tkn.TokenFrequencies(text)
+	tokens, _ := tkn.Encode(text)
+	var total int64
+	for _, n := range freqs {
+		total += n
+	}
+	if total != int64(len(tokens)) || err != nil {
+		t.Fatalf(`TokenFrequencies(%q) = %v, %v, want counts summing to %d`, text, freqs, err, len(tokens))
+	}
+	for _, v := range tokens {
+		if freqs[v] == 0 {
+			t.Fatalf(`TokenFrequencies(%q) = %v, want a count for %d`, text, freqs, v)
+		}
+	}
+}
+
+// TestTokenDensity tests that each byte is given the length of its token.
+func TestTokenDensity(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{"a", "b", "ab", "abc", "é"} {
+		tkn.AddTokenString(token, id)
+	}
+
+	data := []byte("abcabéa")
+	want := []int{3, 3, 3, 2, 2, 2, 2, 1}
+	if density, err := tkn.TokenDensity(data); !intSliceEquals(density, want) || err != nil {
+		t.Fatalf(`TokenDensity(%q) = %v, %v, want equal to %v`, data, density, err, want)
+	}
+
+	data = []byte("abx")
+	if density, err := tkn.TokenDensity(data); !intSliceEquals(density, []int{2, 2}) || err != ErrCannotTokenize {
+		t.Fatalf(`TokenDensity(%q) = %v, %v, want equal to [2 2], %v`, data, density, err, ErrCannotTokenize)
+	}
+}
+
+// TestSplitSentences tests splitting encoded text into sentences.
+func TestSplitSentences(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	sentences := []string{"Hello, world!", " Pi is about 3.14.", " Is it?\n\n", "今日はいい天気ですね。", "The end."}
+	tokens, _ := tkn.EncodeString(strings.Join(sentences, ""))
+
+	chunks, err := tkn.SplitSentences(tokens)
+	if err != nil {
+		t.Fatalf(`SplitSentences(%v) = _, %v`, tokens, err)
+	}
+	var got []string
+	for _, chunk := range chunks {
+		text, _ := tkn.DecodeToString(chunk)
+		got = append(got, text)
+	}
+	if strings.Join(got, "|") != strings.Join(sentences, "|") {
+		t.Fatalf(`SplitSentences(%v) decodes to %q, want equal to %q`, tokens, got, sentences)
+	}
+
+	if _, err := tkn.SplitSentences([]int{33155, -1}); err != ErrUnknownToken {
+		t.Fatalf(`SplitSentences([33155 -1]) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// TestCoverageStats tests that English text is mostly covered by multi-byte
+// tokens, and bytes that form no text only by single-byte tokens.
+func TestCoverageStats(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	text := []byte("The quick brown fox jumps over the lazy dog, again and again.")
+	multi, single, err := tkn.CoverageStats(text)
+	if multi < 10 || single > 3 || err != nil {
+		t.Fatalf(`CoverageStats(%q) = %d, %d, %v, want mostly multi-byte`, text, multi, single, err)
+	}
+
+	// UTF-8 continuation bytes that follow no lead byte.
+	var blob []byte
+	for i := 0; i < 256; i++ {
+		blob = append(blob, byte(0x80+i*37%64))
+	}
+	if multi, single, err := tkn.CoverageStats(blob); multi != 0 || single != len(blob) || err != nil {
+		t.Fatalf(`CoverageStats(blob) = %d, %d, %v, want equal to 0, %d`, multi, single, err, len(blob))
+	}
+}
+
+// TestLineTokenCounts tests counting the tokens on each line of a document.
+func TestLineTokenCounts(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{"a", "b", "c", " ", "\n", "ab", ".\n\n", "."} {
+		tkn.AddTokenString(token, id)
+	}
+
+	text := "ab\na b c\n\nabab.\n\nc.\n"
+	want := []int{2, 6, 1, 3, 0, 3, 0}
+	if counts, err := tkn.LineTokenCounts(text); !intSliceEquals(counts, want) || err != nil {
+		t.Fatalf(`LineTokenCounts(%q) = %v, %v, want equal to %v`, text, counts, err, want)
+	}
+
+	text = "a\nbx\nc"
+	if counts, err := tkn.LineTokenCounts(text); !intSliceEquals(counts, []int{2, 1, 0}) || err != ErrCannotTokenize {
+		t.Fatalf(`LineTokenCounts(%q) = %v, %v, want equal to [2 1 0], %v`, text, counts, err, ErrCannotTokenize)
+	}
+}
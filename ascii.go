@@ -0,0 +1,88 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import "math"
+
+// asciiNode is a node of the ASCII trie, a flattened copy of the part of the
+// trie that is reachable through ASCII bytes. Children are indices into the
+// ASCII trie, with zero, the index of the root, meaning no child. Nodes are
+// a quarter of the size of dense trie nodes and share one allocation, so
+// more of the trie stays in cache.
+type asciiNode struct {
+	children [128]int32
+	value    int32
+}
+
+// buildASCIITrie returns the ASCII trie for root, or nil if a token ID does
+// not fit in an int32.
+func buildASCIITrie(root *trieNode) []asciiNode {
+	nodes := make([]asciiNode, 0, 1024)
+	var add func(node *trieNode) (int32, bool)
+	add = func(node *trieNode) (int32, bool) {
+		if node.value < math.MinInt32 || node.value > math.MaxInt32 {
+			return 0, false
+		}
+		i := int32(len(nodes))
+		nodes = append(nodes, asciiNode{value: int32(node.value)})
+
+		ok := true
+		node.eachChild(func(c byte, child *trieNode) {
+			if c >= 0x80 || !ok {
+				return
+			}
+			var j int32
+			if j, ok = add(child); ok {
+				nodes[i].children[c] = j
+			}
+		})
+		return i, ok
+	}
+
+	if _, ok := add(root); !ok {
+		return nil
+	}
+	return nodes
+}
+
+// isASCII reports whether data consists only of ASCII bytes.
+func isASCII(data []byte) bool {
+	for _, c := range data {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeASCII is encodeAppend for input that consists only of ASCII bytes,
+// using the ASCII trie. Since no token containing a non-ASCII byte can match
+// such input, the result is the same as with the full trie.
+func (t *Tokenizer) encodeASCII(tokens []int, data []byte) ([]int, error) {
+	nodes := t.asciiTrie
+	n := 0
+	for n < len(data) {
+		node, n2, id := &nodes[0], n, -1
+		for i := n; i < len(data); i++ {
+			next := node.children[data[i]]
+			if next == 0 {
+				break
+			}
+			node = &nodes[next]
+			if node.value != -1 {
+				n2, id = i+1, int(node.value)
+			}
+		}
+
+		if id == -1 {
+			var ok bool
+			if tokens, n2, ok = t.fallback(tokens, data, n); !ok {
+				return tokens, ErrCannotTokenize
+			}
+		} else {
+			tokens = append(tokens, id)
+		}
+		n = n2
+	}
+	return tokens, nil
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+)
+
+// binaryMagic identifies the compiled vocabulary format.
+//
+// The format starts with binaryMagic, followed by the trie in preorder.
+// Each node is written as its value (varint, -1 for none) and its number of
+// children (uvarint), followed by each child as an edge byte and the child
+// node itself. Only edges leading to tokens are stored, so the size is
+// proportional to the vocabulary rather than to the number of nodes times
+// 256. The trie is followed by the entries it cannot represent because
+// another ID shares their token (uvarint count, then varint ID, uvarint
+// length and bytes for each), and by the special token IDs (uvarint count,
+// then a varint for each).
+const binaryMagic = "rwkvtkn\x01"
+
+// WriteBinary writes the Tokenizer's vocabulary to w in a compact binary
+// format that can be loaded with NewTokenizerFromBinary.
+func (t *Tokenizer) WriteBinary(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(binaryMagic)
+	writeBinaryNode(bw, t.trie)
+
+	var extra []int
+	for id, token := range t.i2t {
+		if t.t2i[token] != id {
+			extra = append(extra, id)
+		}
+	}
+	sort.Ints(extra)
+	writeUvarint(bw, uint64(len(extra)))
+	for _, id := range extra {
+		writeVarint(bw, int64(id))
+		writeUvarint(bw, uint64(len(t.i2t[id])))
+		bw.WriteString(t.i2t[id])
+	}
+
+	special := make([]int, 0, len(t.special))
+	for id := range t.special {
+		special = append(special, id)
+	}
+	sort.Ints(special)
+	writeUvarint(bw, uint64(len(special)))
+	for _, id := range special {
+		writeVarint(bw, int64(id))
+	}
+
+	return bw.Flush()
+}
+
+func writeBinaryNode(bw *bufio.Writer, node *trieNode) {
+	var edges []byte
+	node.eachChild(func(c byte, child *trieNode) {
+		if child.hasValue() {
+			edges = append(edges, c)
+		}
+	})
+	sort.Slice(edges, func(i, j int) bool { return edges[i] < edges[j] })
+
+	writeVarint(bw, int64(node.value))
+	writeUvarint(bw, uint64(len(edges)))
+	for _, c := range edges {
+		bw.WriteByte(c)
+		writeBinaryNode(bw, node.child(c))
+	}
+}
+
+func writeVarint(bw *bufio.Writer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	bw.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func writeUvarint(bw *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// NewTokenizerFromBinary creates a new Tokenizer whose vocabulary is read
+// from r in the format written by WriteBinary.
+func NewTokenizerFromBinary(r io.Reader) (*Tokenizer, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != binaryMagic {
+		return nil, ErrMalformedVocabulary
+	}
+
+	t := NewTokenizer()
+	if err := t.readBinaryNode(br, t.trie, nil); err != nil {
+		return nil, err
+	}
+
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, ErrMalformedVocabulary
+	}
+	for ; n > 0; n-- {
+		id, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, ErrMalformedVocabulary
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, ErrMalformedVocabulary
+		}
+		var token strings.Builder
+		if _, err := io.CopyN(&token, br, int64(size)); err != nil {
+			return nil, ErrMalformedVocabulary
+		}
+		t.i2t[int(id)] = token.String()
+	}
+
+	n, err = binary.ReadUvarint(br)
+	if err != nil {
+		return nil, ErrMalformedVocabulary
+	}
+	for ; n > 0; n-- {
+		id, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, ErrMalformedVocabulary
+		}
+		t.special[int(id)] = true
+	}
+	return t, nil
+}
+
+func (t *Tokenizer) readBinaryNode(br *bufio.Reader, node *trieNode, key []byte) error {
+	value, err := binary.ReadVarint(br)
+	if err != nil {
+		return ErrMalformedVocabulary
+	}
+	node.value = int(value)
+	if node.value != -1 {
+		t.t2i[string(key)] = node.value
+		t.i2t[node.value] = string(key)
+	}
+
+	edges, err := binary.ReadUvarint(br)
+	if err != nil || edges > 256 {
+		return ErrMalformedVocabulary
+	}
+	for ; edges > 0; edges-- {
+		c, err := br.ReadByte()
+		if err != nil {
+			return ErrMalformedVocabulary
+		}
+		child := &trieNode{value: -1}
+		node.setChild(c, child)
+		if err := t.readBinaryNode(br, child, append(key, c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package rwkvtkn
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestBinaryRoundtrip tests that the World vocabulary survives a round trip
+// through the binary format, and that the result is smaller than the text
+// vocabulary file.
+func TestBinaryRoundtrip(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.AddSpecialToken("<|endoftext|>", 70000)
+	tkn.AddToken([]byte{0xff}, 70001)
+
+	var b bytes.Buffer
+	if err := tkn.WriteBinary(&b); err != nil {
+		t.Fatalf(`WriteBinary() = %v`, err)
+	}
+	t.Logf("binary size: %d bytes, text size: %d bytes", b.Len(), len(rwkvVocab20230424))
+	if b.Len() >= len(rwkvVocab20230424) {
+		t.Fatalf(`WriteBinary() wrote %d bytes, want fewer than %d`, b.Len(), len(rwkvVocab20230424))
+	}
+
+	tkn2, err := NewTokenizerFromBinary(&b)
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromBinary() = %v`, err)
+	}
+	if len(tkn2.i2t) != len(tkn.i2t) || len(tkn2.t2i) != len(tkn.t2i) {
+		t.Fatalf(`NewTokenizerFromBinary() has %d IDs and %d tokens, want %d and %d`, len(tkn2.i2t), len(tkn2.t2i), len(tkn.i2t), len(tkn.t2i))
+	}
+	for id, token := range tkn.i2t {
+		if x, err := tkn2.IDToToken(id); x != token || err != nil {
+			t.Fatalf(`IDToToken(%d) = %q, %v, want equal to %q`, id, x, err, token)
+		}
+	}
+	if k, err := tkn2.TokenKind(70000); k != KindSpecial || err != nil {
+		t.Fatalf(`TokenKind(70000) = %v, %v, want equal to %v`, k, err, KindSpecial)
+	}
+	if err := tkn2.SelfTest(); err != nil {
+		t.Fatalf(`SelfTest() = %v, want nil`, err)
+	}
+
+	if _, err := NewTokenizerFromBinary(bytes.NewReader(rwkvVocab20230424)); err != ErrMalformedVocabulary {
+		t.Fatalf(`NewTokenizerFromBinary(text vocabulary) = %v, want %v`, err, ErrMalformedVocabulary)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// TokenBuffer holds the result of EncodeStringBuffered. Its storage is
+// reused across calls, so encoding into the same TokenBuffer repeatedly
+// does not allocate once it has grown large enough.
+type TokenBuffer struct {
+	IDs []int
+}
+
+var tokenBufferPool = sync.Pool{
+	New: func() any {
+		return &TokenBuffer{IDs: make([]int, 0, 256)}
+	},
+}
+
+// GetTokenBuffer returns a TokenBuffer from a shared pool.
+func GetTokenBuffer() *TokenBuffer {
+	return tokenBufferPool.Get().(*TokenBuffer)
+}
+
+// PutTokenBuffer returns buf to the shared pool. buf must not be used
+// afterwards.
+func PutTokenBuffer(buf *TokenBuffer) {
+	tokenBufferPool.Put(buf)
+}
+
+// EncodeStringBuffered encodes the given string, replacing the contents of
+// buf.IDs with the tokens.
+func (t *Tokenizer) EncodeStringBuffered(text string, buf *TokenBuffer) (err error) {
+	// The trie only reads from data, so it is safe to alias the string.
+	data := unsafe.Slice(unsafe.StringData(text), len(text))
+	if err := t.checkInput(data); err != nil {
+		buf.IDs = buf.IDs[:0]
+		return err
+	}
+
+	buf.IDs, err = t.encodeDocuments(buf.IDs[:0], data)
+	return
+}
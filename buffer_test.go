@@ -0,0 +1,46 @@
+package rwkvtkn
+
+import (
+	"testing"
+)
+
+// TestEncodeStringBuffered tests that encoding into a pooled TokenBuffer
+// matches EncodeString and does not allocate once warmed up.
+func TestEncodeStringBuffered(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world! こんにちは、世界！"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := GetTokenBuffer()
+	defer PutTokenBuffer(buf)
+	if err := tkn.EncodeStringBuffered(s, buf); !intSliceEquals(buf.IDs, i) || err != nil {
+		t.Fatalf(`EncodeStringBuffered(%q) = %v, %v, want equal to %v`, s, buf.IDs, err, i)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		tkn.EncodeStringBuffered(s, buf)
+	})
+	if allocs != 0 {
+		t.Fatalf(`EncodeStringBuffered(%q) allocated %v times per run, want 0`, s, allocs)
+	}
+}
+
+func BenchmarkEncodeStringBuffered(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+	text := string(benchmarkText)
+
+	b.SetBytes(int64(len(text)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := GetTokenBuffer()
+		if err := tkn.EncodeStringBuffered(text, buf); err != nil {
+			b.Fatal(err)
+		}
+		PutTokenBuffer(buf)
+	}
+}
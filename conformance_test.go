@@ -0,0 +1,67 @@
+package rwkvtkn
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// pythonVocabDigest is the VocabHash of the World vocabulary as parsed by
+// the reference Python tokenizer. See testdata/gen_python_fixtures.py.
+const pythonVocabDigest = "511eacadd9524e497807f1d211466818dd71269666a479179ef29b225f6ec3ac"
+
+// TestPythonVocabConformance tests that every vocabulary entry is parsed
+// to the same bytes as the reference Python tokenizer.
+func TestPythonVocabConformance(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	if x := tkn.VocabHash(); x != pythonVocabDigest {
+		t.Fatalf(`VocabHash() = %s, want equal to %s`, x, pythonVocabDigest)
+	}
+}
+
+// TestPythonEncodeConformance tests that encoding matches the reference
+// Python tokenizer on the fixtures in testdata/python_fixtures.jsonl.
+func TestPythonEncodeConformance(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	f, err := os.Open("testdata/python_fixtures.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var fixture struct {
+			Text   *string `json:"text"`
+			Bytes  []int   `json:"bytes"`
+			Tokens []int   `json:"tokens"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &fixture); err != nil {
+			t.Fatal(err)
+		}
+
+		var data []byte
+		if fixture.Text != nil {
+			data = []byte(*fixture.Text)
+		} else {
+			for _, v := range fixture.Bytes {
+				data = append(data, byte(v))
+			}
+		}
+
+		x, err := tkn.Encode(data)
+		if !intSliceEquals(x, fixture.Tokens) || err != nil {
+			t.Errorf(`Encode(%q) = %v, %v, want equal to %v`, data, x, err, fixture.Tokens)
+		}
+
+		y, err := tkn.Decode(fixture.Tokens)
+		if string(y) != string(data) || err != nil {
+			t.Errorf(`Decode(%v) = %q, %v, want equal to %q`, fixture.Tokens, y, err, data)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
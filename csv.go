@@ -0,0 +1,39 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// WriteVocabCSV writes the vocabulary to w as CSV, for inspection in
+// spreadsheets and other external tools. After a header row, there is one
+// row per entry, in order of ID, with the columns id, length (in bytes),
+// is_utf8 (true or false) and literal_escaped, which is the token escaped as
+// in a Go string literal without the surrounding quotes.
+func (t *Tokenizer) WriteVocabCSV(w io.Writer) error {
+	ids := make([]int, 0, len(t.i2t))
+	for id := range t.i2t {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "length", "is_utf8", "literal_escaped"})
+	for _, id := range ids {
+		token := t.i2t[id]
+		q := strconv.Quote(token)
+		cw.Write([]string{
+			strconv.Itoa(id),
+			strconv.Itoa(len(token)),
+			strconv.FormatBool(utf8.ValidString(token)),
+			q[1 : len(q)-1],
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"testing"
+)
+
+// TestWriteVocabCSV tests that the CSV has a row for each vocabulary entry
+// and that the escaped literals parse back to the tokens.
+func TestWriteVocabCSV(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	var b bytes.Buffer
+	if err := tkn.WriteVocabCSV(&b); err != nil {
+		t.Fatalf(`WriteVocabCSV() = %v`, err)
+	}
+
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf(`csv.Reader.ReadAll() = _, %v`, err)
+	}
+	if len(rows) != len(tkn.i2t)+1 {
+		t.Fatalf(`WriteVocabCSV() wrote %d rows, want equal to %d`, len(rows), len(tkn.i2t)+1)
+	}
+	if header := rows[0]; len(header) != 4 || header[0] != "id" || header[3] != "literal_escaped" {
+		t.Fatalf(`WriteVocabCSV() wrote header %q`, header)
+	}
+
+	invalid := 0
+	for _, row := range rows[1:] {
+		id, _ := strconv.Atoi(row[0])
+		token, err := strconv.Unquote(`"` + row[3] + `"`)
+		if want, _ := tkn.IDToToken(id); token != want || err != nil {
+			t.Fatalf(`WriteVocabCSV() wrote row %q, want literal of %q`, row, want)
+		}
+		if row[1] != strconv.Itoa(len(token)) {
+			t.Fatalf(`WriteVocabCSV() wrote row %q, want length %d`, row, len(token))
+		}
+		if row[2] == "false" {
+			invalid++
+		}
+	}
+	if invalid == 0 {
+		t.Fatalf(`WriteVocabCSV() marked every token as valid UTF-8`)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import "unicode/utf8"
+
+// Encoder encodes input that arrives in pieces, such as text typed into an
+// interactive program. It returns tokens as soon as they are certain, holding
+// back only the end of the input that could still become part of a longer
+// token once more input arrives. The tokens from all calls together are the
+// same as Encode would give for the whole input, except that newline
+// normalization is not applied.
+type Encoder struct {
+	t       *Tokenizer
+	buf     []byte
+	started bool
+}
+
+// NewEncoder returns an Encoder that encodes with the Tokenizer.
+func (t *Tokenizer) NewEncoder() *Encoder {
+	return &Encoder{t: t}
+}
+
+// Write adds data to the input and returns the tokens that can be decided so
+// far. A token is decided once the input following its start is no longer a
+// prefix of any token, since no further input can then change the match. If
+// the input cannot be tokenized, Write returns ErrCannotTokenize along with
+// the tokens before that point, and the input is left at the byte that could
+// not be tokenized; call Reset to discard it.
+func (e *Encoder) Write(data []byte) ([]int, error) {
+	e.buf = append(e.buf, data...)
+	if !e.started {
+		if len(e.buf) == 0 || !utf8.FullRune(e.buf) {
+			return nil, nil
+		}
+		e.started = true
+		if e.t.needsPrefixSpace(e.buf) {
+			e.buf = append(e.buf, 0)
+			copy(e.buf[1:], e.buf)
+			e.buf[0] = ' '
+		}
+	}
+
+	t := e.t
+	var tokens []int
+	n := 0
+	for n < len(e.buf) {
+		rest := e.buf[n:]
+		if t.couldBeginToken(rest) {
+			break
+		}
+
+		n2, id := t.findLongest(e.buf, n)
+		if n2 == n || id == -1 {
+			if t.runeFallback && !utf8.FullRune(rest) {
+				break
+			}
+			var ok bool
+			if tokens, n2, ok = t.fallback(tokens, e.buf, n); !ok {
+				e.buf = append(e.buf[:0], rest...)
+				return tokens, ErrCannotTokenize
+			}
+		} else {
+			tokens = append(tokens, id)
+		}
+		n = n2
+	}
+	e.buf = append(e.buf[:0], e.buf[n:]...)
+	return tokens, nil
+}
+
+// Flush encodes and returns the input held back by Write, as at the end of
+// the input, and empties it. Further input is encoded as a continuation of
+// the same text, so no prefix space is added to it.
+func (e *Encoder) Flush() ([]int, error) {
+	if !e.started && len(e.buf) > 0 {
+		e.started = true
+		if e.t.needsPrefixSpace(e.buf) {
+			e.buf = append([]byte{' '}, e.buf...)
+		}
+	}
+
+	tokens, err := e.t.encodeAppend(nil, e.buf)
+	e.buf = e.buf[:0]
+	return tokens, err
+}
+
+// Reset discards any held input and prepares the Encoder for new text.
+func (e *Encoder) Reset() {
+	e.buf = e.buf[:0]
+	e.started = false
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestEncoderBytewise tests that a token is only emitted once enough input
+// has arrived to rule out a longer token.
+func TestEncoderBytewise(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{"h", "e", "l", "o", "he", "hell", "hello", " "} {
+		tkn.AddTokenString(token, id)
+	}
+
+	e := tkn.NewEncoder()
+	for _, c := range []struct {
+		in   string
+		want []int
+	}{
+		{"h", nil},
+		{"e", nil},
+		{"l", nil},
+		{"l", nil},
+		{"o", nil},
+		{" ", []int{6}},
+		{"h", []int{7}},
+		{"e", nil},
+		{"l", nil},
+	} {
+		tokens, err := e.Write([]byte(c.in))
+		if !intSliceEquals(tokens, c.want) || err != nil {
+			t.Fatalf(`Write(%q) = %v, %v, want equal to %v`, c.in, tokens, err, c.want)
+		}
+	}
+
+	if tokens, err := e.Flush(); !intSliceEquals(tokens, []int{4, 2}) || err != nil {
+		t.Fatalf(`Flush() = %v, %v, want equal to [4 2]`, tokens, err)
+	}
+
+	// No token matches "p", so it is rejected and kept until Reset.
+	if tokens, err := e.Write([]byte("hop")); !intSliceEquals(tokens, []int{0, 3}) || err != ErrCannotTokenize {
+		t.Fatalf(`Write("hop") = %v, %v, want equal to [0 3], %v`, tokens, err, ErrCannotTokenize)
+	}
+	if tokens, err := e.Write([]byte("o")); tokens != nil || err != ErrCannotTokenize {
+		t.Fatalf(`Write("o") = %v, %v, want equal to [], %v`, tokens, err, ErrCannotTokenize)
+	}
+	e.Reset()
+	if tokens, err := e.Write([]byte("oh")); !intSliceEquals(tokens, []int{3}) || err != nil {
+		t.Fatalf(`Write("oh") = %v, %v, want equal to [3]`, tokens, err)
+	}
+}
+
+// TestEncoderMatchesEncode tests that the tokens from writing input in small
+// pieces are the same as from encoding it at once.
+func TestEncoderMatchesEncode(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.SetAddPrefixSpace(true)
+	text := "Hello, world! こんにちは、世界！\n\n\tfunc main() {}"
+	want, _ := tkn.EncodeString(text)
+
+	for _, size := range []int{1, 2, 3, 7} {
+		e := tkn.NewEncoder()
+		var tokens []int
+		for i := 0; i < len(text); i += size {
+			x, err := e.Write([]byte(text[i:min(i+size, len(text))]))
+			if err != nil {
+				t.Fatalf(`Write() = _, %v`, err)
+			}
+			tokens = append(tokens, x...)
+		}
+		x, err := e.Flush()
+		if tokens = append(tokens, x...); !intSliceEquals(tokens, want) || err != nil {
+			t.Fatalf(`Write() in pieces of %d = %v, %v, want equal to %v`, size, tokens, err, want)
+		}
+	}
+}
+
+// TestEncoderFallback tests that input is held back while a token of the
+// fallback vocabulary could still match it.
+func TestEncoderFallback(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 0)
+	tkn.SetFallback(newWorldTokenizer(t))
+
+	text := "Hello world, a banana"
+	want, _ := tkn.EncodeString(text)
+	e := tkn.NewEncoder()
+	var tokens []int
+	for i := 0; i < len(text); i++ {
+		x, err := e.Write([]byte{text[i]})
+		if err != nil {
+			t.Fatalf(`Write(%q) = _, %v`, text[i], err)
+		}
+		tokens = append(tokens, x...)
+	}
+	x, err := e.Flush()
+	if tokens = append(tokens, x...); !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`Write() bytewise = %v, %v, want equal to %v`, tokens, err, want)
+	}
+
+	if n, _, err := tkn.CountReader(iotest.OneByteReader(strings.NewReader(text))); n != int64(len(want)) || err != nil {
+		t.Fatalf(`CountReader(%q) = %d, _, %v, want equal to %d`, text, n, err, len(want))
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// isRegionalIndicator reports whether r is one of the letters used in pairs
+// to form flag emoji.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// extendsGrapheme reports whether r continues the grapheme cluster ending
+// with prev. It is a simplification of the Unicode rules covering combining
+// marks, variation selectors, emoji modifiers, tags and zero-width joiner
+// sequences, which is enough to avoid breaking up common emoji.
+func extendsGrapheme(prev, r rune) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return true
+	case r == '\u200d' || prev == '\u200d':
+		return true
+	case r >= 0xfe00 && r <= 0xfe0f:
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		return true
+	case r >= 0xe0020 && r <= 0xe007f:
+		return true
+	default:
+		return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc)
+	}
+}
+
+// isGraphemeBoundary reports whether b can be split at index i without
+// breaking up a grapheme cluster.
+func isGraphemeBoundary(b []byte, i int) bool {
+	if i <= 0 || i >= len(b) {
+		return true
+	}
+	if !utf8.RuneStart(b[i]) {
+		return false
+	}
+
+	prev, _ := utf8.DecodeLastRune(b[:i])
+	r, _ := utf8.DecodeRune(b[i:])
+	if isRegionalIndicator(prev) && isRegionalIndicator(r) {
+		// Regional indicators pair up, so count how many precede i.
+		n := 0
+		for j := i; j > 0; n++ {
+			p, size := utf8.DecodeLastRune(b[:j])
+			if !isRegionalIndicator(p) {
+				break
+			}
+			j -= size
+		}
+		return n%2 == 0
+	}
+	return !extendsGrapheme(prev, r)
+}
+
+// DecodeTruncated decodes an int slice of tokens to a string of at most
+// maxRunes characters. Decoding stops at the last token boundary that fits
+// within the limit and does not split a character or a grapheme cluster,
+// such as an emoji sequence, so the result may be shorter than maxRunes.
+func (t *Tokenizer) DecodeTruncated(tokens []int, maxRunes int) (text string, err error) {
+	var b []byte
+	boundaries := []int{0}
+	runes, counted := 0, 0
+	started := false
+	for _, v := range tokens {
+		tokStr, ok := t.decodeToken(v)
+		if !ok {
+			err = ErrUnknownToken
+			continue
+		}
+
+		// Strip the prefix space before counting, so that it does not use
+		// up the limit.
+		if !started && tokStr != "" {
+			started = true
+			if t.addPrefixSpace && tokStr[0] == ' ' {
+				tokStr = tokStr[1:]
+			}
+		}
+		b = append(b, tokStr...)
+		complete := completeUTF8Prefix(b)
+		runes += utf8.RuneCount(b[counted:complete])
+		counted = complete
+		if runes > maxRunes {
+			break
+		}
+		boundaries = append(boundaries, len(b))
+	}
+
+	for i := len(boundaries) - 1; i >= 0; i-- {
+		cut := boundaries[i]
+		if completeUTF8Prefix(b[:cut]) == cut && utf8.RuneCount(b[:cut]) <= maxRunes && isGraphemeBoundary(b, cut) {
+			text = string(b[:cut])
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package rwkvtkn
+
+import (
+	"testing"
+)
+
+// TestDecodeTruncated tests truncating CJK text and emoji sequences near the
+// limit.
+func TestDecodeTruncated(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	for _, tc := range []struct {
+		text     string
+		maxRunes int
+		want     string
+	}{
+		{"こんにちは、世界！", 100, "こんにちは、世界！"},
+		{"こんにちは、世界！", 7, "こんにちは、世"},
+		{"こんにちは、世界！", 0, ""},
+		{"ab👍🏽c", 3, "ab"},
+		{"ab👍🏽c", 4, "ab👍🏽"},
+		{"🇯🇵🇯🇵", 3, "🇯🇵"},
+		{"e\u0301e\u0301", 3, "e\u0301"},
+	} {
+		i, err := tkn.EncodeString(tc.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := tkn.DecodeTruncated(i, tc.maxRunes)
+		if x != tc.want || err != nil {
+			t.Fatalf(`DecodeTruncated(%v, %d) = %q, %v, want equal to %q`, i, tc.maxRunes, x, err, tc.want)
+		}
+	}
+}
+
+// TestDecodeTruncatedPrefixSpace tests that the prefix space is stripped
+// without counting against the limit.
+func TestDecodeTruncatedPrefixSpace(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{" ", " hello", " world"} {
+		tkn.AddTokenString(token, id)
+	}
+	tkn.SetAddPrefixSpace(true)
+
+	tokens, _ := tkn.EncodeString("hello world")
+	if x, err := tkn.DecodeTruncated(tokens, 5); x != "hello" || err != nil {
+		t.Fatalf(`DecodeTruncated(%v, 5) = %q, %v, want equal to "hello"`, tokens, x, err)
+	}
+	if x, err := tkn.DecodeTruncated(tokens, 11); x != "hello world" || err != nil {
+		t.Fatalf(`DecodeTruncated(%v, 11) = %q, %v, want equal to "hello world"`, tokens, x, err)
+	}
+}
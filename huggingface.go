@@ -0,0 +1,119 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// byteLevelAlphabet maps each byte to the printable character that the
+// HuggingFace (originally GPT-2) byte-level encoding represents it with.
+// Printable Latin-1 bytes map to themselves; the rest map, in order, to the
+// code points from U+0100 up.
+var byteLevelAlphabet = func() (alphabet [256]rune) {
+	n := 0
+	for c := range alphabet {
+		if (c >= '!' && c <= '~') || (c >= 0xa1 && c <= 0xac) || (c >= 0xae && c <= 0xff) {
+			alphabet[c] = rune(c)
+		} else {
+			alphabet[c] = rune(256 + n)
+			n++
+		}
+	}
+	return
+}()
+
+// byteLevelEncode returns token in the HuggingFace byte-level encoding.
+func byteLevelEncode(token string) string {
+	var b strings.Builder
+	for i := 0; i < len(token); i++ {
+		b.WriteRune(byteLevelAlphabet[token[i]])
+	}
+	return b.String()
+}
+
+type hfAddedToken struct {
+	ID         int    `json:"id"`
+	Content    string `json:"content"`
+	SingleWord bool   `json:"single_word"`
+	LStrip     bool   `json:"lstrip"`
+	RStrip     bool   `json:"rstrip"`
+	Normalized bool   `json:"normalized"`
+	Special    bool   `json:"special"`
+}
+
+type hfByteLevel struct {
+	Type           string `json:"type"`
+	AddPrefixSpace bool   `json:"add_prefix_space"`
+	TrimOffsets    bool   `json:"trim_offsets"`
+	UseRegex       bool   `json:"use_regex"`
+}
+
+type hfWordPiece struct {
+	Type                    string         `json:"type"`
+	UnkToken                string         `json:"unk_token"`
+	ContinuingSubwordPrefix string         `json:"continuing_subword_prefix"`
+	MaxInputCharsPerWord    int            `json:"max_input_chars_per_word"`
+	Vocab                   map[string]int `json:"vocab"`
+}
+
+type hfTokenizer struct {
+	Version       string         `json:"version"`
+	Truncation    any            `json:"truncation"`
+	Padding       any            `json:"padding"`
+	AddedTokens   []hfAddedToken `json:"added_tokens"`
+	Normalizer    any            `json:"normalizer"`
+	PreTokenizer  hfByteLevel    `json:"pre_tokenizer"`
+	PostProcessor any            `json:"post_processor"`
+	Decoder       hfByteLevel    `json:"decoder"`
+	Model         hfWordPiece    `json:"model"`
+}
+
+// WriteHuggingFaceJSON writes the Tokenizer's vocabulary to w as a
+// tokenizer.json file for the HuggingFace tokenizers library.
+//
+// Tokens are stored in the byte-level encoding, which represents each byte
+// as a printable character. Since the RWKV tokenizer matches the longest
+// token greedily rather than applying BPE merges, the model is written as
+// WordPiece with an empty subword prefix, whose matching is the same, and
+// the byte-level pre-tokenizer is configured to not split the input.
+// Special tokens are also written as added tokens. Options such as
+// SetAddPrefixSpace are not exported, and when several IDs share a token,
+// only the one TokenToID returns is kept.
+func (t *Tokenizer) WriteHuggingFaceJSON(w io.Writer) error {
+	vocab := make(map[string]int, len(t.t2i))
+	for token, id := range t.t2i {
+		vocab[byteLevelEncode(token)] = id
+	}
+
+	added := make([]hfAddedToken, 0, len(t.special))
+	for id := range t.special {
+		added = append(added, hfAddedToken{ID: id, Content: t.i2t[id], Special: true})
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].ID < added[j].ID })
+
+	unk := "[UNK]"
+	if token, ok := t.i2t[t.unknownID]; ok {
+		unk = byteLevelEncode(token)
+	}
+
+	byteLevel := hfByteLevel{Type: "ByteLevel", TrimOffsets: true}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(hfTokenizer{
+		Version:      "1.0",
+		AddedTokens:  added,
+		PreTokenizer: byteLevel,
+		Decoder:      byteLevel,
+		Model: hfWordPiece{
+			Type:                 "WordPiece",
+			UnkToken:             unk,
+			MaxInputCharsPerWord: math.MaxInt32,
+			Vocab:                vocab,
+		},
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// TestWriteHuggingFaceJSON tests that the exported tokenizer.json is valid
+// JSON whose vocabulary decodes back to the original tokens.
+func TestWriteHuggingFaceJSON(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.AddSpecialToken("<|endoftext|>", 0)
+
+	var buf bytes.Buffer
+	if err := tkn.WriteHuggingFaceJSON(&buf); err != nil {
+		t.Fatalf(`WriteHuggingFaceJSON() = %v`, err)
+	}
+
+	var hf hfTokenizer
+	if err := json.Unmarshal(buf.Bytes(), &hf); err != nil {
+		t.Fatalf(`json.Unmarshal() = %v`, err)
+	}
+	if hf.Model.Type != "WordPiece" || hf.PreTokenizer.Type != "ByteLevel" || hf.PreTokenizer.UseRegex {
+		t.Fatalf(`WriteHuggingFaceJSON() wrote model %q, pre-tokenizer %+v`, hf.Model.Type, hf.PreTokenizer)
+	}
+	if len(hf.AddedTokens) != 1 || hf.AddedTokens[0].ID != 0 || hf.AddedTokens[0].Content != "<|endoftext|>" {
+		t.Fatalf(`WriteHuggingFaceJSON() wrote added tokens %+v`, hf.AddedTokens)
+	}
+
+	unalphabet := make(map[rune]byte)
+	for c, r := range byteLevelAlphabet {
+		unalphabet[r] = byte(c)
+	}
+	if len(unalphabet) != 256 {
+		t.Fatalf(`byteLevelAlphabet has %d distinct characters, want equal to 256`, len(unalphabet))
+	}
+
+	if len(hf.Model.Vocab) != len(tkn.t2i) {
+		t.Fatalf(`WriteHuggingFaceJSON() wrote %d tokens, want equal to %d`, len(hf.Model.Vocab), len(tkn.t2i))
+	}
+	for encoded, id := range hf.Model.Vocab {
+		var token []byte
+		for _, r := range encoded {
+			c, ok := unalphabet[r]
+			if !ok {
+				t.Fatalf(`WriteHuggingFaceJSON() wrote token %q with character %q outside the byte-level alphabet`, encoded, r)
+			}
+			token = append(token, c)
+		}
+		if want := tkn.i2t[id]; string(token) != want {
+			t.Fatalf(`WriteHuggingFaceJSON() wrote token %q for ID %d, want equal to %q`, token, id, want)
+		}
+	}
+}
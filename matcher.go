@@ -0,0 +1,101 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+// Matcher is a longest-match dictionary of byte patterns, built on the same
+// trie the tokenizer uses. It is independent of any vocabulary and can be
+// used for things like keyword spotting.
+//
+// A Matcher is not safe for concurrent use while patterns are being inserted;
+// once built, it may be searched from multiple goroutines.
+type Matcher struct {
+	root *trieNode
+	n    int
+}
+
+// NewMatcher returns an empty Matcher.
+func NewMatcher() *Matcher {
+	return &Matcher{root: &trieNode{value: -1}}
+}
+
+// Insert adds pattern to the matcher with the given value, replacing the
+// value of an existing identical pattern. Empty patterns are ignored. The
+// value must not be negative, as negative values are reserved to mark nodes
+// that do not end a pattern.
+func (m *Matcher) Insert(pattern []byte, value int) {
+	if len(pattern) == 0 {
+		return
+	}
+	if value < 0 {
+		panic("rwkvtkn: negative Matcher value")
+	}
+	if !m.Contains(pattern) {
+		m.n++
+	}
+	m.root.Insert(pattern, value)
+}
+
+// InsertString is like Insert, but takes a string pattern.
+func (m *Matcher) InsertString(pattern string, value int) {
+	m.Insert([]byte(pattern), value)
+}
+
+// Contains reports whether pattern was inserted into the matcher.
+func (m *Matcher) Contains(pattern []byte) bool {
+	_, ok := m.Get(pattern)
+	return ok
+}
+
+// Get returns the value of pattern, if it was inserted into the matcher.
+func (m *Matcher) Get(pattern []byte) (value int, ok bool) {
+	node := m.root
+	for _, c := range pattern {
+		if node = node.child(c); node == nil {
+			return -1, false
+		}
+	}
+	return node.value, node.value != -1
+}
+
+// Len returns the number of patterns in the matcher.
+func (m *Matcher) Len() int {
+	return m.n
+}
+
+// FindLongest returns the longest pattern that matches data starting at
+// index. The match covers data[index:end]. If no pattern matches, or index is
+// out of range, ok is false.
+func (m *Matcher) FindLongest(data []byte, index int) (end, value int, ok bool) {
+	if index < 0 || index >= len(data) {
+		return 0, -1, false
+	}
+	end, value = m.root.FindLongest(data, index)
+	return end, value, value != -1
+}
+
+// FindAll calls fn for every pattern that matches data starting at index, in
+// order of increasing length.
+func (m *Matcher) FindAll(data []byte, index int, fn func(end, value int)) {
+	if index < 0 {
+		return
+	}
+	m.root.FindAll(data, index, fn)
+}
+
+// Scan walks data from left to right, calling fn for the longest pattern
+// matching at each position and resuming after the match. Positions where no
+// pattern matches are skipped one byte at a time. Scan stops early if fn
+// returns false.
+func (m *Matcher) Scan(data []byte, fn func(start, end, value int) bool) {
+	for i := 0; i < len(data); {
+		end, value, ok := m.FindLongest(data, i)
+		if !ok {
+			i++
+			continue
+		}
+		if !fn(i, end, value) {
+			return
+		}
+		i = end
+	}
+}
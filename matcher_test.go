@@ -0,0 +1,65 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import "testing"
+
+// TestMatcherFindLongest tests that the longest inserted pattern wins, and
+// that a later insert of the same pattern replaces its value.
+func TestMatcherFindLongest(t *testing.T) {
+	m := NewMatcher()
+	m.InsertString("go", 1)
+	m.InsertString("gopher", 2)
+	m.InsertString("goph", 3)
+	m.InsertString("go", 4)
+
+	if m.Len() != 3 {
+		t.Fatalf(`Len() = %d, want equal to 3`, m.Len())
+	}
+
+	data := []byte("a gophers' gopro")
+	for _, c := range []struct {
+		index, end, value int
+		ok                bool
+	}{
+		{2, 8, 2, true},
+		{11, 13, 4, true},
+		{0, 0, -1, false},
+		{3, 0, -1, false},
+		{len(data), 0, -1, false},
+	} {
+		end, value, ok := m.FindLongest(data, c.index)
+		if end != c.end || value != c.value || ok != c.ok {
+			t.Fatalf(`FindLongest(%q, %d) = %d, %d, %v, want equal to %d, %d, %v`, data, c.index, end, value, ok, c.end, c.value, c.ok)
+		}
+	}
+}
+
+// TestMatcherScan tests that Scan reports non-overlapping longest matches.
+func TestMatcherScan(t *testing.T) {
+	m := NewMatcher()
+	m.InsertString("he", 1)
+	m.InsertString("hers", 2)
+	m.InsertString("she", 3)
+
+	var got []int
+	m.Scan([]byte("ushers and he"), func(start, end, value int) bool {
+		got = append(got, start, end, value)
+		return true
+	})
+	if want := []int{1, 4, 3, 11, 13, 1}; !intSliceEquals(got, want) {
+		t.Fatalf(`Scan() = %v, want equal to %v`, got, want)
+	}
+
+	var all []int
+	m.FindAll([]byte("hers"), 0, func(end, value int) {
+		all = append(all, end, value)
+	})
+	if want := []int{2, 1, 4, 2}; !intSliceEquals(all, want) {
+		t.Fatalf(`FindAll("hers", 0) = %v, want equal to %v`, all, want)
+	}
+
+	if _, ok := m.Get([]byte("her")); ok {
+		t.Fatalf(`Get("her") = _, true, want equal to false`)
+	}
+}
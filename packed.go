@@ -0,0 +1,50 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+// EncodePacked encodes the given byte slice into tokens, packing each token
+// ID as a little-endian unsigned integer of width bytes, which must be 2, 3
+// or 4. It returns ErrIDOutOfRange if a token ID does not fit in width bytes.
+func (t *Tokenizer) EncodePacked(data []byte, width int) ([]byte, error) {
+	if width < 2 || width > 4 {
+		return nil, ErrInvalidPackedWidth
+	}
+
+	tokens, err := t.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := uint64(1) << (8 * width)
+	packed := make([]byte, 0, len(tokens)*width)
+	for _, v := range tokens {
+		if v < 0 || uint64(v) >= limit {
+			return nil, ErrIDOutOfRange
+		}
+		for i := 0; i < width; i++ {
+			packed = append(packed, byte(v>>(8*i)))
+		}
+	}
+	return packed, nil
+}
+
+// DecodePacked unpacks token IDs packed by EncodePacked with the same width.
+// It returns ErrMalformedPacked if the length of packed is not a multiple of
+// width.
+func (t *Tokenizer) DecodePacked(packed []byte, width int) ([]int, error) {
+	if width < 2 || width > 4 {
+		return nil, ErrInvalidPackedWidth
+	} else if len(packed)%width != 0 {
+		return nil, ErrMalformedPacked
+	}
+
+	tokens := make([]int, 0, len(packed)/width)
+	for i := 0; i < len(packed); i += width {
+		v := 0
+		for j := width - 1; j >= 0; j-- {
+			v = v<<8 | int(packed[i+j])
+		}
+		tokens = append(tokens, v)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,36 @@
+package rwkvtkn
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEncodePacked tests packing and unpacking tokens with widths 2 and 4,
+// and rejecting IDs that do not fit.
+func TestEncodePacked(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world!"
+	i := []int{33155, 45, 40213, 34}
+	for width, p := range map[int][]byte{
+		2: {0x83, 0x81, 45, 0, 0x15, 0x9d, 34, 0},
+		4: {0x83, 0x81, 0, 0, 45, 0, 0, 0, 0x15, 0x9d, 0, 0, 34, 0, 0, 0},
+	} {
+		x, err := tkn.EncodePacked([]byte(s), width)
+		if !bytes.Equal(x, p) || err != nil {
+			t.Fatalf(`EncodePacked(%q, %d) = %v, %v, want equal to %v`, s, width, x, err, p)
+		}
+		y, err := tkn.DecodePacked(x, width)
+		if !intSliceEquals(y, i) || err != nil {
+			t.Fatalf(`DecodePacked(%v, %d) = %v, %v, want equal to %v`, x, width, y, err, i)
+		}
+	}
+
+	tkn.AddTokenString("\U0001F600", 1<<16)
+	if _, err := tkn.EncodePacked([]byte("\U0001F600"), 2); err != ErrIDOutOfRange {
+		t.Fatalf(`EncodePacked(%q, 2) = _, %v, want %v`, "\U0001F600", err, ErrIDOutOfRange)
+	}
+	if _, err := tkn.DecodePacked([]byte{1, 2, 3}, 2); err != ErrMalformedPacked {
+		t.Fatalf(`DecodePacked([1 2 3], 2) = _, %v, want %v`, err, ErrMalformedPacked)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// textReader is an io.Reader that lazily decodes tokens yielded by next.
+type textReader struct {
+	t         *Tokenizer
+	next      func() (int, bool)
+	buf       []byte
+	started   bool
+	done      bool
+	graphemes bool
+}
+
+// NewTextReader returns an io.Reader that decodes the tokens yielded by
+// next, which should return false once there are no more tokens. Decoded
+// text is held back until it ends on a complete UTF-8 character, so
+// multi-byte characters split across tokens are never returned partially
+// by a single Read unless p is too small to hold them. Like the other decode
+// methods, it strips the space added by SetAddPrefixSpace.
+func (t *Tokenizer) NewTextReader(next func() (int, bool)) io.Reader {
+	return &textReader{t: t, next: next}
+}
+
+// NewGraphemeTextReader is like NewTextReader, but holds decoded text back
+// until it ends on a complete grapheme cluster rather than a complete
+// character, so that a cluster made of several characters, such as an emoji
+// joined with zero-width joiners or followed by a skin tone modifier, is
+// never returned partially by a single Read. Since more text could always
+// extend the last cluster, it is only returned once the next cluster has
+// begun or the tokens have run out.
+func (t *Tokenizer) NewGraphemeTextReader(next func() (int, bool)) io.Reader {
+	return &textReader{t: t, next: next, graphemes: true}
+}
+
+func (r *textReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	ready := r.completePrefix()
+	for ready == 0 && !r.done {
+		id, ok := r.next()
+		if !ok {
+			r.done = true
+			break
+		}
+
+		tokStr, ok := r.t.decodeToken(id)
+		if !ok {
+			return 0, ErrUnknownToken
+		}
+		r.buf = append(r.buf, tokStr...)
+		if !r.started && len(r.buf) > 0 {
+			r.started = true
+			if r.t.addPrefixSpace && r.buf[0] == ' ' {
+				r.buf = r.buf[1:]
+			}
+		}
+		ready = r.completePrefix()
+	}
+
+	if r.done {
+		ready = len(r.buf)
+	}
+	if ready == 0 {
+		return 0, io.EOF
+	}
+
+	n = copy(p, r.buf[:ready])
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// completePrefix returns the length of the longest prefix of the buffer
+// that does not end with an incomplete UTF-8 character, or, if graphemes is
+// set, that ends before the last grapheme cluster.
+func (r *textReader) completePrefix() int {
+	n := completeUTF8Prefix(r.buf)
+	if !r.graphemes {
+		return n
+	}
+	for i := n - 1; i > 0; i-- {
+		if isGraphemeBoundary(r.buf[:n], i) {
+			return i
+		}
+	}
+	return 0
+}
+
+// completeUTF8Prefix returns the length of the longest prefix of b that does
+// not end with an incomplete UTF-8 character.
+func completeUTF8Prefix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// maxTokenLen returns the length, in bytes, of the longest token that
+// encoding may match, including tokens of the fallback chain.
+func (t *Tokenizer) maxTokenLen() int {
+	n := 0
+	for f := t; f != nil; f = f.fallbackTkn {
+		fn := 0
+		for token := range f.t2i {
+			fn = max(fn, len(token))
+		}
+		if f.maxMatchLen > 0 {
+			fn = min(fn, f.maxMatchLen)
+		}
+		n = max(n, fn)
+	}
+	return n
+}
+
+// CountReader encodes everything read from r and returns the number of
+// tokens and bytes read, without storing the tokens. It uses a fixed-size
+// buffer regardless of the amount of data.
+func (t *Tokenizer) CountReader(r io.Reader) (tokens int64, bytes int64, err error) {
+	// A token match starting more than window bytes before the end of the
+	// buffer cannot be affected by data that has not been read yet.
+	window := max(t.maxTokenLen(), utf8.UTFMax)
+	size := max(64*1024, 2*window)
+	buf := make([]byte, 0, size+1)
+	var scratch [utf8.UTFMax]int
+
+	first, eof := true, false
+	for !eof || len(buf) > 0 {
+		if !eof {
+			start := len(buf)
+			nr, rerr := r.Read(buf[start:size])
+			bytes += int64(nr)
+			buf = buf[:start+nr]
+			if first && nr > 0 {
+				first = false
+				if t.needsPrefixSpace(buf) {
+					buf = append(buf, 0)
+					copy(buf[1:], buf)
+					buf[0] = ' '
+				}
+			}
+
+			if rerr == io.EOF {
+				eof = true
+			} else if rerr != nil {
+				return tokens, bytes, rerr
+			}
+		}
+
+		n := 0
+		for n < len(buf) && (eof || len(buf)-n > window) {
+			ids, n2, ok := t.matchNext(scratch[:0], buf, n)
+			if !ok {
+				return tokens, bytes, ErrCannotTokenize
+			}
+			tokens += int64(len(ids))
+			n = n2
+		}
+		buf = buf[:copy(buf, buf[n:])]
+	}
+	return
+}
@@ -0,0 +1,138 @@
+package rwkvtkn
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func sliceTokenSource(tokens []int) func() (int, bool) {
+	return func() (int, bool) {
+		if len(tokens) == 0 {
+			return 0, false
+		}
+		id := tokens[0]
+		tokens = tokens[1:]
+		return id, true
+	}
+}
+
+// TestTextReader tests reading decoded text one byte at a time, including
+// a character split across byte tokens.
+func TestTextReader(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world! こんにちは、世界！"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// U+4E16 '世' as three single-byte tokens.
+	i = append(i, 0xe4+1, 0xb8+1, 0x96+1)
+	s += "世"
+
+	x, err := io.ReadAll(iotest.OneByteReader(tkn.NewTextReader(sliceTokenSource(i))))
+	if string(x) != s || err != nil {
+		t.Fatalf(`ReadAll(NewTextReader(%v)) = %q, %v, want equal to %q`, i, x, err, s)
+	}
+
+	_, err = io.ReadAll(tkn.NewTextReader(sliceTokenSource([]int{33155, -1})))
+	if err != ErrUnknownToken {
+		t.Fatalf(`ReadAll(NewTextReader([33155 -1])) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// TestGraphemeTextReader tests that a family emoji, a zero-width joiner
+// sequence decoded from single-byte tokens, is never returned partially.
+func TestGraphemeTextReader(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	family := "\U0001F468\u200D\U0001F469\u200D\U0001F467"
+	i, _ := tkn.EncodeString("Hi ")
+	for _, c := range []byte(family) {
+		i = append(i, int(c)+1)
+	}
+	tail, _ := tkn.EncodeString("!")
+	i = append(i, tail...)
+
+	// chunks returns the text returned by each Read from r.
+	chunks := func(r io.Reader) (chunks []string) {
+		p := make([]byte, 64)
+		for {
+			n, err := r.Read(p)
+			if n > 0 {
+				chunks = append(chunks, string(p[:n]))
+			}
+			if err == io.EOF {
+				return chunks
+			} else if err != nil {
+				t.Fatalf(`Read() = _, %v`, err)
+			}
+		}
+	}
+
+	x := chunks(tkn.NewGraphemeTextReader(sliceTokenSource(i)))
+	want := []string{"H", "i", " ", family, "!"}
+	if strings.Join(x, "|") != strings.Join(want, "|") {
+		t.Fatalf(`NewGraphemeTextReader(%v) read %q, want equal to %q`, i, x, want)
+	}
+
+	// Without grapheme awareness, the emoji is returned a character at a time.
+	if x := chunks(tkn.NewTextReader(sliceTokenSource(i))); len(x) <= len(want) {
+		t.Fatalf(`NewTextReader(%v) read %q, want the emoji split up`, i, x)
+	}
+}
+
+// TestTextReaderPrefixSpace tests that the text readers strip the prefix
+// space like DecodeToString.
+func TestTextReaderPrefixSpace(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{" ", " hello", " world"} {
+		tkn.AddTokenString(token, id)
+	}
+	tkn.SetAddPrefixSpace(true)
+
+	tokens, _ := tkn.EncodeString("hello world")
+	for _, r := range []io.Reader{
+		tkn.NewTextReader(sliceTokenSource(tokens)),
+		tkn.NewGraphemeTextReader(sliceTokenSource(tokens)),
+	} {
+		if x, err := io.ReadAll(r); string(x) != "hello world" || err != nil {
+			t.Fatalf(`ReadAll(%T) = %q, %v, want equal to "hello world"`, r, x, err)
+		}
+	}
+
+	// Only the first space is stripped.
+	x, _ := io.ReadAll(tkn.NewTextReader(sliceTokenSource([]int{0, 1})))
+	if string(x) != " hello" {
+		t.Fatalf(`ReadAll(NewTextReader([0 1])) = %q, want equal to " hello"`, x)
+	}
+}
+
+// TestCountReader tests that streaming counts match encoding all of the data
+// at once, including when tokens span reads.
+func TestCountReader(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	small := []byte("Hello, world! こんにちは、世界！")
+	for _, tc := range []struct {
+		data []byte
+		r    io.Reader
+	}{
+		{benchmarkText, bytes.NewReader(benchmarkText)},
+		{small, iotest.OneByteReader(bytes.NewReader(small))},
+		{nil, bytes.NewReader(nil)},
+	} {
+		i, err := tkn.Encode(tc.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, y, err := tkn.CountReader(tc.r)
+		if x != int64(len(i)) || y != int64(len(tc.data)) || err != nil {
+			t.Fatalf(`CountReader() = %d, %d, %v, want equal to %d, %d`, x, y, err, len(i), len(tc.data))
+		}
+	}
+}
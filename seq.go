@@ -0,0 +1,45 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+//go:build go1.23
+
+package rwkvtkn
+
+import (
+	"iter"
+	"unicode/utf8"
+)
+
+// EncodeSeq returns an iterator over the tokens of data, which are matched
+// lazily as the iterator is consumed. If data is rejected as by Encode, or
+// cannot be tokenized, the iterator yields -1 and the error, then stops.
+func (t *Tokenizer) EncodeSeq(data []byte) iter.Seq2[int, error] {
+	return func(yield func(int, error) bool) {
+		if err := t.checkInput(data); err != nil {
+			yield(-1, err)
+			return
+		}
+
+		var scratch [utf8.UTFMax]int
+		rest := data
+		for more := true; more; {
+			var doc []byte
+			doc, rest, more = t.splitDocument(rest)
+			for n := 0; n < len(doc); {
+				ids, n2, ok := t.matchNext(scratch[:0], doc, n)
+				if !ok {
+					yield(-1, ErrCannotTokenize)
+					return
+				}
+				for _, id := range ids {
+					if !yield(id, nil) {
+						return
+					}
+				}
+				n = n2
+			}
+			if more && !yield(t.docSepID, nil) {
+				return
+			}
+		}
+	}
+}
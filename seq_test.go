@@ -0,0 +1,122 @@
+//go:build go1.23
+
+package rwkvtkn
+
+import (
+	"testing"
+)
+
+// TestEncodeSeq tests that EncodeSeq yields the same tokens as Encode and
+// supports stopping early.
+func TestEncodeSeq(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world! こんにちは、世界！"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var x []int
+	for id, err := range tkn.EncodeSeq([]byte(s)) {
+		if err != nil {
+			t.Fatalf(`EncodeSeq(%q) yielded error %v`, s, err)
+		}
+		x = append(x, id)
+	}
+	if !intSliceEquals(x, i) {
+		t.Fatalf(`EncodeSeq(%q) = %v, want equal to %v`, s, x, i)
+	}
+
+	x = x[:0]
+	for id := range tkn.EncodeSeq([]byte(s)) {
+		if len(x) == 3 {
+			break
+		}
+		x = append(x, id)
+	}
+	if !intSliceEquals(x, i[:3]) {
+		t.Fatalf(`EncodeSeq(%q) with break = %v, want equal to %v`, s, x, i[:3])
+	}
+}
+
+// TestEncodeSeqReuse tests that ranging over the same iterator twice yields
+// the same tokens, even when the input is prepared with a prefix space.
+func TestEncodeSeqReuse(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.SetAddPrefixSpace(true)
+
+	s := "Hello"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq := tkn.EncodeSeq([]byte(s))
+	for pass := 0; pass < 2; pass++ {
+		var x []int
+		for id, err := range seq {
+			if err != nil {
+				t.Fatalf(`EncodeSeq(%q) yielded error %v`, s, err)
+			}
+			x = append(x, id)
+		}
+		if !intSliceEquals(x, i) {
+			t.Fatalf(`EncodeSeq(%q) pass %d = %v, want equal to %v`, s, pass, x, i)
+		}
+	}
+}
+
+// TestEncodeSeqDocumentSeparator tests that EncodeSeq splits documents the
+// same way as Encode.
+func TestEncodeSeqDocumentSeparator(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.SetDocumentSeparator(0, 0)
+
+	s := "ab\x00ab\x00"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var x []int
+	for id, err := range tkn.EncodeSeq([]byte(s)) {
+		if err != nil {
+			t.Fatalf(`EncodeSeq(%q) yielded error %v`, s, err)
+		}
+		x = append(x, id)
+	}
+	if !intSliceEquals(x, i) {
+		t.Fatalf(`EncodeSeq(%q) = %v, want equal to %v`, s, x, i)
+	}
+}
+
+// TestEncodeSeqRejected tests that EncodeSeq yields the error for input that
+// Encode rejects instead of any tokens.
+func TestEncodeSeqRejected(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("\uFFFD", 2)
+
+	for _, tc := range []struct {
+		s   string
+		set func()
+		err error
+	}{
+		{"aaa", func() { tkn.SetMaxInputBytes(2) }, ErrInputTooLarge},
+		{"a\uFFFD", func() {
+			tkn.SetMaxInputBytes(0)
+			tkn.SetRejectReplacementChar(true)
+		}, ErrReplacementChar},
+	} {
+		tc.set()
+		var x []int
+		var errs []error
+		for id, err := range tkn.EncodeSeq([]byte(tc.s)) {
+			x, errs = append(x, id), append(errs, err)
+		}
+		if len(x) != 1 || x[0] != -1 || errs[0] != tc.err {
+			t.Fatalf(`EncodeSeq(%q) yielded %v, %v, want equal to [-1], [%v]`, tc.s, x, errs, tc.err)
+		}
+	}
+}
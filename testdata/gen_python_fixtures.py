@@ -0,0 +1,87 @@
+# Generates python_fixtures.jsonl from a port of the reference TRIE_TOKENIZER
+# in the rwkv Python package. Run from the repository root:
+#
+#   python3 testdata/gen_python_fixtures.py rwkv_vocab_v20230424.txt > testdata/python_fixtures.jsonl
+#
+# A SHA-256 digest of the parsed vocabulary is printed to stderr.
+import json, sys
+
+class TRIE:
+    __slots__ = ("ch", "to", "values", "front")
+    def __init__(self, front=None, ch=None):
+        self.ch = ch; self.to = [None for _ in range(256)]; self.values = set(); self.front = front
+    def add(self, key, idx=0, val=None):
+        if idx == len(key):
+            if val is None: val = key
+            self.values.add(val); return self
+        ch = key[idx]
+        if self.to[ch] is None: self.to[ch] = TRIE(front=self, ch=ch)
+        return self.to[ch].add(key, idx=idx+1, val=val)
+    def find_longest(self, key, idx=0):
+        u = self; ch = key[idx]
+        while u.to[ch] is not None:
+            u = u.to[ch]; idx += 1
+            if u.values: ret = idx, u, u.values
+            if idx == len(key): break
+            ch = key[idx]
+        return ret
+
+class TRIE_TOKENIZER:
+    def __init__(self, file_name):
+        self.idx2token = {}
+        sorted = []
+        with open(file_name, "r", encoding="utf-8") as f:
+            lines = f.readlines()
+        for l in lines:
+            idx = int(l[:l.index(' ')])
+            x = eval(l[l.index(' '):l.rindex(' ')])
+            x = x.encode("utf-8") if isinstance(x, str) else x
+            assert isinstance(x, bytes)
+            assert len(x) == int(l[l.rindex(' '):])
+            sorted += [x]
+            self.idx2token[idx] = x
+        self.token2idx = {v: int(k) for k, v in self.idx2token.items()}
+        self.root = TRIE()
+        for t, i in self.token2idx.items():
+            self.root.add(t, val=(t, i))
+    def encodeBytes(self, src):
+        idx = 0; tokens = []
+        while idx < len(src):
+            _idx = idx
+            idx, _, values = self.root.find_longest(src, idx)
+            assert idx != _idx
+            _, token = next(iter(values))
+            tokens.append(token)
+        return tokens
+
+tk = TRIE_TOKENIZER(sys.argv[1])
+fixtures = [
+    "",
+    "Hello, world!",
+    "Hello, world! こんにちは、世界！",
+    "  leading and trailing spaces  ",
+    "\n\n\ttabs\tand\nnewlines\r\n",
+    "The quick brown fox jumps over the lazy dog.",
+    "Le cœur a ses raisons que la raison ne connaît point.",
+    "Пример текста на русском языке.",
+    "你好，世界！这是一个测试。",
+    "안녕하세요 세계",
+    "مرحبا بالعالم",
+    "emoji: 👍🏽 👨‍👩‍👧‍👦 🇯🇵",
+    "func main() { fmt.Println(\"hello\") }",
+    "<|endoftext|>",
+    "1234567890 3.14159 1e-10 0xdeadbeef",
+    "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+    "\x00\x01\x02\x7f",
+    "User: What is RWKV?\n\nAssistant:",
+]
+for s in fixtures:
+    print(json.dumps({"text": s, "tokens": tk.encodeBytes(s.encode("utf-8"))}, ensure_ascii=False))
+# Invalid UTF-8 inputs are given as byte lists.
+for b in [b"\xff\xfe\x80", b"abc\xe4\xb8", b"\xc3\x28"]:
+    print(json.dumps({"bytes": list(b), "tokens": tk.encodeBytes(b)}))
+import hashlib
+h = hashlib.sha256()
+for i in sorted(tk.idx2token):
+    h.update(b"%d:%s\n" % (i, tk.idx2token[i].hex().encode()))
+print(h.hexdigest(), file=sys.stderr)
@@ -5,95 +5,264 @@ package rwkvtkn
 import (
 	"bufio"
 	"bytes"
-	_ "embed"
+	"compress/gzip"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
 )
 
 var (
 	ErrMalformedVocabulary = errors.New("malformed tokenizer vocabulary")
 	ErrUnknownToken        = errors.New("unknown token ID")
 	ErrCannotTokenize      = errors.New("cannot tokenize data")
+	ErrSelfTestFailed      = errors.New("tokenizer self-test failed")
+	ErrTokenConflict       = errors.New("conflicting vocabulary entry")
+	ErrIDOutOfRange        = errors.New("token ID out of range")
+	ErrInvalidPackedWidth  = errors.New("invalid packed token width")
+	ErrMalformedPacked     = errors.New("malformed packed tokens")
+	ErrInvalidRange        = errors.New("invalid token range")
+	ErrInputTooLarge       = errors.New("input too large")
+	ErrUndefinedVariable   = errors.New("undefined template variable")
+	ErrReplacementChar     = errors.New("input contains the Unicode replacement character")
+	ErrNonPositiveCount    = errors.New("count must be positive")
+
+	ErrNoEmbeddedVocabulary = errors.New("built without the embedded World vocabulary (rwkvtkn_novocab); load a vocabulary with NewTokenizerFromFile")
 )
 
-type trieNode struct {
-	children [256]*trieNode
-	value    int
+// Tokenizer is a trie-based RWKV tokenizer.
+type Tokenizer struct {
+	trie    *trieNode
+	t2i     map[string]int
+	i2t     map[int]string
+	special map[int]bool
+
+	// reserved holds IDs that decode to reservedPlaceholder while they are
+	// not assigned a token.
+	reserved            map[int]bool
+	reservedPlaceholder string
+
+	// decodeTable, if built by PrepareDecode, mirrors i2t for IDs below
+	// its length.
+	decodeTable []decodeEntry
+
+	// asciiTrie, if built by PrepareEncode, is used to encode ASCII-only
+	// input. It is discarded whenever the vocabulary changes.
+	asciiTrie []asciiNode
+
+	unknownID      int
+	runeFallback   bool
+	maxMatchLen    int
+	addPrefixSpace bool
+	normNewlines   bool
+	maxInputBytes  int
+	rejectFFFD     bool
+	bosID, eosID   int
+	decodeFilter   func(string) string
+
+	docSep   byte
+	docSepID int
+
+	// fallbackTkn, if set, is tried where no token of this vocabulary
+	// matches. Its IDs are shifted up by fallbackOffset.
+	fallbackTkn    *Tokenizer
+	fallbackOffset int
+
+	// lenientLengths makes readVocab accept a token length given in runes.
+	lenientLengths bool
+	// maxLoadID, if not negative, makes readVocab skip entries with
+	// larger IDs.
+	maxLoadID int
+	// progress, if set, is called by readVocab with the number of entries
+	// read so far after every progressEvery entries.
+	progress      func(entries int)
+	progressEvery int
 }
 
-func (t *trieNode) Insert(key []byte, value int) {
-	node := t
-	for _, c := range key {
-		ci := c
-		if node.children[ci] == nil {
-			node.children[ci] = &trieNode{value: -1}
-		}
+// NewTokenizer creates a new Tokenizer with an empty vocabulary.
+func NewTokenizer() *Tokenizer {
+	return &Tokenizer{
+		trie:    &trieNode{value: -1},
+		t2i:     make(map[string]int),
+		i2t:     make(map[int]string),
+		special: make(map[int]bool),
 
-		node = node.children[ci]
+		reserved: make(map[int]bool),
+
+		unknownID: -1,
+		bosID:     -1,
+		eosID:     -1,
+		docSepID:  -1,
+		maxLoadID: -1,
 	}
-	node.value = value
 }
 
-func (t *trieNode) InsertString(key string, value int) {
-	t.Insert([]byte(key), value)
-}
+var singleUnescapeFixer = strings.NewReplacer("\"", "\\\"", "\\'", "'")
 
-func (t *trieNode) FindLongest(data []byte, index int) (endIndex, value int) {
-	node := t
-	endIndex, value = 0, -1
-	for node.children[data[index]] != nil {
-		node = node.children[data[index]]
-		index += 1
+// fixUnicodeEscapes rewrites the \xNN escapes in a quoted Python string
+// literal as \u00NN, since in a Python str they denote a code point rather
+// than a byte. Other escapes, including \u, \U and an escaped backslash
+// followed by an x, are left untouched.
+func fixUnicodeEscapes(lit string) string {
+	if !strings.Contains(lit, "\\x") {
+		return lit
+	}
 
-		if node.value != -1 {
-			endIndex = index
-			value = node.value
+	var b strings.Builder
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '\\' || i+1 == len(lit) {
+			b.WriteByte(lit[i])
+			continue
 		}
 
-		if index == len(data) {
-			break
+		i++
+		if lit[i] == 'x' {
+			b.WriteString("\\u00")
+		} else {
+			b.WriteByte('\\')
+			b.WriteByte(lit[i])
 		}
 	}
-	return
+	return b.String()
 }
 
-// Tokenizer is a trie-based RWKV tokenizer.
-type Tokenizer struct {
-	trie *trieNode
-	t2i  map[string]int
-	i2t  map[int]string
+// NewTokenizer creates a new Tokenizer whose vocabulary is read from
+// the supplied io.Reader. Gzip-compressed vocabularies are detected and
+// decompressed automatically.
+//
+// An entry can be wrapped across several lines by ending each line but the
+// last with a backslash, as in a Python string literal. The backslash and
+// line break are removed, and leading whitespace on the next line is kept as
+// part of the entry. A line ending in an escaped backslash (\\) is not
+// continued.
+func NewTokenizerFromReader(r io.Reader) (*Tokenizer, error) {
+	t := NewTokenizer()
+	if err := t.readVocab(r); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
-// NewTokenizer creates a new Tokenizer with an empty vocabulary.
-func NewTokenizer() *Tokenizer {
-	return &Tokenizer{
-		trie: &trieNode{value: -1},
-		t2i:  make(map[string]int),
-		i2t:  make(map[int]string),
+// NewTokenizerFromReaderLenient is like NewTokenizerFromReader, but also
+// accepts vocabulary entries whose trailing length field is the number of
+// characters in the token rather than the number of bytes. Some exports of
+// RWKV-style vocabularies compute the length with Python's len() on the
+// decoded str instead of on its UTF-8 encoding, which gives a different
+// count for any token containing non-ASCII text; such vocabularies are
+// rejected by NewTokenizerFromReader as malformed.
+func NewTokenizerFromReaderLenient(r io.Reader) (*Tokenizer, error) {
+	t := NewTokenizer()
+	t.lenientLengths = true
+	if err := t.readVocab(r); err != nil {
+		return nil, err
 	}
+	return t, nil
 }
 
-var singleUnescapeFixer = strings.NewReplacer("\"", "\\\"", "\\'", "'")
-var unicodeUnescapeFixer = strings.NewReplacer("\\x", "\\u00")
+// NewTokenizerFromReaderMaxID is like NewTokenizerFromReader, but skips
+// vocabulary entries whose ID is greater than maxID, giving a smaller
+// vocabulary for experiments on vocabulary size. Encoding input that needs a
+// skipped token falls back to shorter tokens, and fails with
+// ErrCannotTokenize if there are none; with the World vocabulary, whose
+// single-byte tokens have IDs 1 to 256, encoding cannot fail as long as
+// maxID is at least 256. A negative maxID loads every entry.
+func NewTokenizerFromReaderMaxID(r io.Reader, maxID int) (*Tokenizer, error) {
+	t := NewTokenizer()
+	t.maxLoadID = maxID
+	if err := t.readVocab(r); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
 
-// NewTokenizer creates a new Tokenizer whose vocabulary is read from
-// the supplied io.Reader.
-func NewTokenizerFromReader(r io.Reader) (*Tokenizer, error) {
+// NewTokenizerFromReaderProgress is like NewTokenizerFromReader, but calls
+// progress with the number of vocabulary entries read so far after every
+// every entries, so that programs loading a large vocabulary can report
+// their progress. It returns ErrNonPositiveCount if every is not positive.
+func NewTokenizerFromReaderProgress(r io.Reader, every int, progress func(entries int)) (*Tokenizer, error) {
+	if every <= 0 {
+		return nil, ErrNonPositiveCount
+	}
+
+	t := NewTokenizer()
+	t.progress, t.progressEvery = progress, every
+	if err := t.readVocab(r); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readVocab reads vocabulary entries from r into the Tokenizer. The trie is
+// built once all entries have been read.
+func (t *Tokenizer) readVocab(r io.Reader) error {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
 
-	t := NewTokenizer()
-	for {
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	var readErr error
+	err := t.parseVocab(func() (string, bool) {
 		line, err := br.ReadString('\n')
-		if err == io.EOF {
+		if err != nil && (err != io.EOF || line == "") {
+			if err != io.EOF {
+				readErr = err
+			}
+			return "", false
+		}
+		return line, true
+	})
+	if readErr != nil {
+		return readErr
+	} else if err != nil {
+		return err
+	}
+
+	t.rebuildTrie()
+	return nil
+}
+
+// LoadLines reads vocabulary entries, in the format accepted by
+// NewTokenizerFromReader, from the lines returned by next until it returns
+// false, and adds them to the vocabulary like ReadFrom. The lines may include
+// their line breaks. Since next decides where the entries end, for example
+// at a sentinel line, LoadLines can read a vocabulary embedded in a larger
+// file, such as a section of a model configuration read with a
+// bufio.Scanner. It does not detect gzip compression. If an error occurs,
+// the entries before it are kept.
+func (t *Tokenizer) LoadLines(next func() (line string, ok bool)) error {
+	err := t.parseVocab(next)
+	t.rebuildTrie()
+	return err
+}
+
+// parseVocab adds the vocabulary entries in the lines returned by next to the
+// maps, without updating the trie.
+func (t *Tokenizer) parseVocab(next func() (string, bool)) error {
+	entries := 0
+	for {
+		line, ok := next()
+		if !ok {
 			break
-		} else if err != nil {
-			return nil, err
 		}
 
 		line = strings.TrimSpace(line)
@@ -101,14 +270,22 @@ func NewTokenizerFromReader(r io.Reader) (*Tokenizer, error) {
 			continue
 		}
 
+		for continuesLine(line) {
+			more, ok := next()
+			if !ok {
+				return ErrMalformedVocabulary
+			}
+			line = strings.TrimRightFunc(line[:len(line)-1]+more, unicode.IsSpace)
+		}
+
 		sl, sr := strings.IndexByte(line, ' '), strings.LastIndexByte(line, ' ')
 		if sl == sr || sr == len(line)-1 {
-			return nil, ErrMalformedVocabulary
+			return ErrMalformedVocabulary
 		}
 
 		id, err := strconv.Atoi(line[:sl])
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		tokLit := strings.TrimSpace(line[sl:sr])
@@ -118,7 +295,7 @@ func NewTokenizerFromReader(r io.Reader) (*Tokenizer, error) {
 		}
 
 		if len(tokLit) < 2 || tokLit[0] != tokLit[len(tokLit)-1] {
-			return nil, ErrMalformedVocabulary
+			return ErrMalformedVocabulary
 		}
 
 		switch tokLit[0] {
@@ -126,32 +303,55 @@ func NewTokenizerFromReader(r io.Reader) (*Tokenizer, error) {
 		case '\'':
 			tokLit = "\"" + singleUnescapeFixer.Replace(tokLit[1:len(tokLit)-1]) + "\""
 		default:
-			return nil, ErrMalformedVocabulary
+			return ErrMalformedVocabulary
 		}
 
 		if !tokIsByt {
-			tokLit = unicodeUnescapeFixer.Replace(tokLit)
+			tokLit = fixUnicodeEscapes(tokLit)
 		}
 
 		tokStr, err := strconv.Unquote(tokLit)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		tokLen, err := strconv.Atoi(line[sr+1:])
 		if err != nil {
-			return nil, err
-		} else if tokLen != len(tokStr) {
-			return nil, ErrMalformedVocabulary
+			return err
+		} else if tokLen != len(tokStr) && !(t.lenientLengths && tokLen == utf8.RuneCountInString(tokStr)) {
+			return ErrMalformedVocabulary
+		}
+
+		entries++
+		if t.progress != nil && entries%t.progressEvery == 0 {
+			t.progress(entries)
 		}
 
-		t.AddTokenString(tokStr, id)
+		if t.maxLoadID >= 0 && id > t.maxLoadID {
+			continue
+		}
+		t.addTokenString(tokStr, id, false)
 	}
-	return t, nil
+
+	return nil
+}
+
+// rebuildTrie builds the trie from the vocabulary maps, using multiple
+// goroutines when more than one CPU is available.
+func (t *Tokenizer) rebuildTrie() {
+	t.trie = buildTrie(t.t2i, runtime.GOMAXPROCS(0) > 1)
+}
+
+// continuesLine reports whether a vocabulary line ends with a backslash that
+// continues it onto the next line, as in a Python string literal. An escaped
+// backslash at the end of the line does not continue it.
+func continuesLine(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, "\\"))
+	return n%2 == 1
 }
 
 // NewTokenizer creates a new Tokenizer whose vocabulary is read from
-// the specified file.
+// the specified file, which may be gzip-compressed.
 func NewTokenizerFromFile(path string) (*Tokenizer, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -162,99 +362,1484 @@ func NewTokenizerFromFile(path string) (*Tokenizer, error) {
 	return NewTokenizerFromReader(f)
 }
 
-//go:embed rwkv_vocab_v20230424.txt
-var rwkvVocab20230424 []byte
+// NewTokenizerFromFS creates a new Tokenizer whose vocabulary is read from
+// the specified file in fsys.
+func NewTokenizerFromFS(fsys fs.FS, path string) (*Tokenizer, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewTokenizerFromReader(f)
+}
+
+// NewTokenizerFromHexReader creates a new Tokenizer whose vocabulary is read
+// from the supplied io.Reader in hexadecimal form. Each line consists of a
+// token ID followed by the bytes of the token as space-separated pairs of
+// hex digits, for example "5 68 65 6c 6c 6f" for the token "hello". Blank
+// lines and lines starting with '#' are ignored.
+func NewTokenizerFromHexReader(r io.Reader) (*Tokenizer, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	t := NewTokenizer()
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0][0] != '#' {
+			id, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: invalid token ID %q", ErrMalformedVocabulary, lineNo, fields[0])
+			} else if len(fields) == 1 {
+				return nil, fmt.Errorf("%w: line %d: missing token bytes", ErrMalformedVocabulary, lineNo)
+			}
+
+			token := make([]byte, len(fields)-1)
+			for i, f := range fields[1:] {
+				if len(f) != 2 {
+					return nil, fmt.Errorf("%w: line %d: hex byte %q is not two digits", ErrMalformedVocabulary, lineNo, f)
+				} else if _, err := hex.Decode(token[i:i+1], []byte(f)); err != nil {
+					return nil, fmt.Errorf("%w: line %d: invalid hex byte %q", ErrMalformedVocabulary, lineNo, f)
+				}
+			}
+			t.AddToken(token, id)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return t, nil
+}
+
+// NewTokenizerFromFiles creates a new Tokenizer whose vocabulary is read
+// from each of the specified files in order. Entries in later files take
+// precedence: if a later file assigns a token to an ID that an earlier file
+// already defined, the earlier token is removed from the vocabulary and
+// replaced by the new one.
+func NewTokenizerFromFiles(paths ...string) (*Tokenizer, error) {
+	t := NewTokenizer()
+	for _, path := range paths {
+		if err := t.readVocabFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Tokenizer) readVocabFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return t.readVocab(f)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom by reading vocabulary entries from r, in
+// the format accepted by NewTokenizerFromReader, until EOF. It returns the
+// number of bytes read from r. The entries are added to the existing
+// vocabulary, replacing any token already assigned to the same ID, so
+// ReadFrom can be called several times to combine vocabularies as
+// NewTokenizerFromFiles does. If an error occurs, the entries before it
+// are kept.
+func (t *Tokenizer) ReadFrom(r io.Reader) (n int64, err error) {
+	cr := &countingReader{r: r}
+	if err = t.readVocab(cr); err != nil {
+		t.rebuildTrie()
+	}
+	return cr.n, err
+}
+
+// WorldVocabBytes returns a copy of the embedded RWKV World vocabulary file
+// (rwkv_vocab_20230424), or nil if the package was built with the
+// rwkvtkn_novocab tag.
+func WorldVocabBytes() []byte {
+	return bytes.Clone(rwkvVocab20230424)
+}
 
 // NewWorldTokenizer creates a new Tokenizer with the default RWKV World
-// vocabulary (rwkv_vocab_20230424).
+// vocabulary (rwkv_vocab_20230424). If the package was built with the
+// rwkvtkn_novocab tag, the vocabulary is not available. Since
+// NewWorldTokenizer has no error result, and adding one would break existing
+// callers, it then panics with ErrNoEmbeddedVocabulary, whose message
+// directs users to NewTokenizerFromFile. Use NewWorldTokenizerSafe to get
+// the error returned instead.
 func NewWorldTokenizer() *Tokenizer {
-	t, err := NewTokenizerFromReader(bytes.NewReader(rwkvVocab20230424))
+	t, err := NewWorldTokenizerSafe()
 	if err != nil {
 		panic(err.Error())
 	}
 	return t
 }
 
+// NewWorldTokenizerSafe is like NewWorldTokenizer, but returns an error
+// instead of panicking if the vocabulary is not available or fails to load,
+// so that services can handle it at startup.
+func NewWorldTokenizerSafe() (*Tokenizer, error) {
+	if rwkvVocab20230424 == nil {
+		return nil, ErrNoEmbeddedVocabulary
+	}
+	return loadWorldTokenizer(bytes.NewReader(rwkvVocab20230424))
+}
+
+// loadWorldTokenizer reads a vocabulary from r and checks it with SelfTest.
+func loadWorldTokenizer(r io.Reader) (*Tokenizer, error) {
+	t, err := NewTokenizerFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.SelfTest(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var defaultWorldTokenizer = sync.OnceValue(NewWorldTokenizer)
+
+// DefaultWorldTokenizer returns a Tokenizer with the default vocabulary that
+// is shared by all callers. It is built on the first call, so the embedded
+// vocabulary is only parsed once per process. The shared Tokenizer is safe
+// for concurrent encoding and decoding, but callers must not modify it, such
+// as by adding tokens or changing its options; use NewWorldTokenizer to get
+// a private copy instead. Like NewWorldTokenizer, it panics if the package
+// was built without the embedded vocabulary.
+func DefaultWorldTokenizer() *Tokenizer {
+	return defaultWorldTokenizer()
+}
+
+// selfTestText and selfTestTokens are a sentinel string and its expected
+// encoding under the RWKV World vocabulary.
+var (
+	selfTestText   = "Hello, world! こんにちは、世界！"
+	selfTestTokens = []int{33155, 45, 40213, 34, 33, 10115, 10165, 10136, 10127, 10139, 10079, 10267, 14610, 19126}
+)
+
+// SelfTest checks that the Tokenizer encodes and decodes a built-in sentinel
+// string exactly as the RWKV World vocabulary would. It returns
+// ErrSelfTestFailed if the vocabulary is missing, corrupted or different.
+func (t *Tokenizer) SelfTest() error {
+	tokens, err := t.EncodeString(selfTestText)
+	if err != nil || len(tokens) != len(selfTestTokens) {
+		return ErrSelfTestFailed
+	}
+	for i, v := range tokens {
+		if v != selfTestTokens[i] {
+			return ErrSelfTestFailed
+		}
+	}
+
+	text, err := t.DecodeToString(tokens)
+	if err != nil || text != selfTestText {
+		return ErrSelfTestFailed
+	}
+	return nil
+}
+
 // AddToken adds a token, represented as a byte slice, to the Tokenizer's
 // vocabulary.
 func (t *Tokenizer) AddToken(token []byte, id int) {
+	t.removeID(id)
 	t.trie.Insert(token, id)
+	t.asciiTrie = nil
 
 	t.t2i[string(token)] = id
 	t.i2t[id] = string(token)
+	t.setDecodeEntry(id, string(token), true)
 }
 
 // AddTokenString adds a token, represented as a string, to the Tokenizer's
 // vocabulary.
 func (t *Tokenizer) AddTokenString(token string, id int) {
-	t.trie.InsertString(token, id)
+	t.addTokenString(token, id, true)
+}
+
+// addTokenString adds a token to the vocabulary maps, and to the trie if
+// insert is true. Callers that pass false must rebuild the trie afterwards.
+func (t *Tokenizer) addTokenString(token string, id int, insert bool) {
+	t.removeID(id)
+	if insert {
+		t.trie.InsertString(token, id)
+	}
+	t.asciiTrie = nil
 
 	t.t2i[token] = id
 	t.i2t[id] = token
+	t.setDecodeEntry(id, token, true)
 }
 
-// Encode encodes the given byte slice into an int slice of tokens.
-func (t *Tokenizer) Encode(data []byte) (tokens []int, err error) {
-	n := 0
-	tokens = make([]int, 0, 32)
-	for n < len(data) {
-		n2, id := t.trie.FindLongest(data, n)
-		if n2 == n || id == -1 {
-			return tokens, ErrCannotTokenize
+// AddSpecialToken adds a special token, such as an end-of-text marker, to
+// the Tokenizer's vocabulary. Special tokens are encoded and decoded like
+// any other token, but are reported as KindSpecial by TokenKind.
+func (t *Tokenizer) AddSpecialToken(token string, id int) {
+	t.AddTokenString(token, id)
+	t.special[id] = true
+}
+
+// TryAddToken adds a token, represented as a string, to the Tokenizer's
+// vocabulary unless doing so would overwrite an existing entry. It returns
+// an error wrapping ErrTokenConflict if id is already assigned to a
+// different token or token is already assigned to a different ID.
+func (t *Tokenizer) TryAddToken(token string, id int) error {
+	if old, ok := t.i2t[id]; ok && old != token {
+		return fmt.Errorf("%w: ID %d is already assigned to token %q", ErrTokenConflict, id, old)
+	}
+	if old, ok := t.t2i[token]; ok && old != id {
+		return fmt.Errorf("%w: token %q is already assigned to ID %d", ErrTokenConflict, token, old)
+	}
+
+	t.AddTokenString(token, id)
+	return nil
+}
+
+// removeID removes the token currently assigned to id, if any, so that id
+// can be reassigned. If another ID holds the same token, encoding the token
+// produces that ID from then on.
+func (t *Tokenizer) removeID(id int) {
+	old, ok := t.i2t[id]
+	if !ok {
+		return
+	}
+
+	if t.t2i[old] == id {
+		// Every token in t2i is held by an ID in i2t, so some other ID
+		// can only hold the token if i2t has more entries than t2i.
+		next, found := -1, false
+		if len(t.i2t) > len(t.t2i) {
+			for other, token := range t.i2t {
+				if token == old && other != id && (!found || other < next) {
+					next, found = other, true
+				}
+			}
+		}
+
+		t.trie.InsertString(old, next)
+		t.asciiTrie = nil
+		if found {
+			t.t2i[old] = next
+		} else {
+			delete(t.t2i, old)
 		}
-		tokens = append(tokens, id)
-		n = n2
 	}
-	return
+	delete(t.i2t, id)
+	delete(t.special, id)
+	t.setDecodeEntry(id, "", false)
 }
 
-// EncodeString encodes the given string into an int slice of tokens.
-func (t *Tokenizer) EncodeString(text string) (tokens []int, err error) {
-	return t.Encode([]byte(text))
+// ReserveIDs marks the given IDs as reserved, as for special tokens that
+// are to be added later. Until they are assigned a token, reserved IDs are
+// decoded as the placeholder set by SetReservedPlaceholder, which is empty by
+// default, instead of causing ErrUnknownToken. They are never produced by
+// encoding, are reported as KindReserved by TokenKind, and are still
+// unknown to IDToToken and ValidateIDs.
+func (t *Tokenizer) ReserveIDs(ids ...int) {
+	for _, id := range ids {
+		t.reserved[id] = true
+	}
 }
 
-// Decode decodes an int slice of tokens to a byte slice.
-func (t *Tokenizer) Decode(tokens []int) (data []byte, err error) {
-	var b bytes.Buffer
-	for _, v := range tokens {
-		if tokStr, ok := t.i2t[v]; ok {
-			b.WriteString(tokStr)
-		} else {
-			err = ErrUnknownToken
+// SetReservedPlaceholder sets the string that reserved IDs decode to.
+func (t *Tokenizer) SetReservedPlaceholder(placeholder string) {
+	t.reservedPlaceholder = placeholder
+}
+
+// SetFallback sets a tokenizer whose vocabulary is tried wherever no token
+// of t's vocabulary matches the input, before replacing a byte with its
+// single-byte token or the unknown token ID. This layers a vocabulary on top
+// of another, such as a small custom vocabulary on top of the World
+// vocabulary, without merging them. The fallback may itself have a fallback,
+// forming a chain, but the chain must not lead back to t.
+//
+// The fallback's IDs are mapped into a range above t's own: a fallback ID is
+// encoded as that ID plus FallbackOffset, which is one more than the largest
+// ID in t's vocabulary or reserved by ReserveIDs when SetFallback is called.
+// Decoding maps IDs at or above the offset back to the fallback. Tokens
+// added to t later must therefore use IDs below the offset. The fallback's
+// own settings, such as its prefix space, are not used.
+//
+// Passing nil removes the fallback.
+func (t *Tokenizer) SetFallback(other *Tokenizer) {
+	for f := other; f != nil; f = f.fallbackTkn {
+		if f == t {
+			panic("rwkvtkn: fallback chain leads back to the tokenizer")
 		}
 	}
-	data = b.Bytes()
-	return
+
+	_, offset := t.IDRange()
+	for id := range t.reserved {
+		offset = max(offset, id)
+	}
+	t.fallbackTkn, t.fallbackOffset = other, offset+1
 }
 
-// DecodeToString decodes an int slice of tokens to a string.
-func (t *Tokenizer) DecodeToString(tokens []int) (text string, err error) {
-	var b strings.Builder
-	for _, v := range tokens {
-		if tokStr, ok := t.i2t[v]; ok {
-			b.WriteString(tokStr)
-		} else {
-			err = ErrUnknownToken
+// FallbackOffset returns the amount that IDs of the tokenizer set by
+// SetFallback are shifted by, or 0 if there is no fallback.
+func (t *Tokenizer) FallbackOffset() int {
+	if t.fallbackTkn == nil {
+		return 0
+	}
+	return t.fallbackOffset
+}
+
+// fallbackMatch returns the end index and shifted ID of the longest token
+// that matches data at index n in the first vocabulary along the fallback
+// chain with a match, or n and -1 if there is none.
+func (t *Tokenizer) fallbackMatch(data []byte, n int) (endIndex, value int) {
+	offset := 0
+	for f := t; f.fallbackTkn != nil; f = f.fallbackTkn {
+		offset += f.fallbackOffset
+		if n2, id := f.fallbackTkn.findLongest(data, n); n2 != n && id != -1 {
+			return n2, id + offset
 		}
 	}
-	text = b.String()
-	return
+	return n, -1
 }
 
-// TokenToID returns the ID of the specified token.
-func (t *Tokenizer) TokenToID(token string) (int, error) {
-	if id, ok := t.t2i[token]; ok {
-		return id, nil
-	} else {
-		return -1, ErrCannotTokenize
+// couldBeginToken reports whether a token of t or of a tokenizer along its
+// fallback chain could begin with rest, in which case more input could
+// change the match where rest starts.
+func (t *Tokenizer) couldBeginToken(rest []byte) bool {
+	for f := t; f != nil; f = f.fallbackTkn {
+		if (f.maxMatchLen <= 0 || len(rest) <= f.maxMatchLen) && f.trie.HasPrefix(rest) {
+			return true
+		}
 	}
+	return false
 }
 
-// IDToToken returns the token for the given ID.
-func (t *Tokenizer) IDToToken(id int) (string, error) {
-	if token, ok := t.i2t[id]; ok {
-		return token, nil
-	} else {
-		return "", ErrUnknownToken
+// couldExtendToken reports whether rest is a proper prefix of a token that
+// t or a tokenizer along its fallback chain could match.
+func (t *Tokenizer) couldExtendToken(rest []byte) bool {
+	for f := t; f != nil; f = f.fallbackTkn {
+		if (f.maxMatchLen <= 0 || len(rest) < f.maxMatchLen) && f.trie.canExtend(rest) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEncodeUnknownID sets the token ID that Encode emits for a byte that
+// no token in the vocabulary matches. The byte is skipped and encoding
+// continues. This is useful for vocabularies that are not byte-complete.
+// A negative ID restores the default behavior of failing with
+// ErrCannotTokenize.
+func (t *Tokenizer) SetEncodeUnknownID(id int) {
+	t.unknownID = id
+}
+
+// SetRuneFallback sets whether input that no token matches is replaced a
+// whole UTF-8 character at a time, rather than a byte at a time. When
+// enabled, each byte of the character is replaced with its single-byte
+// token, or with the ID set by SetEncodeUnknownID if there is none; the
+// remaining bytes of the character are never matched as part of a longer
+// token. A byte that does not begin a valid UTF-8 character is still
+// replaced on its own.
+func (t *Tokenizer) SetRuneFallback(enabled bool) {
+	t.runeFallback = enabled
+}
+
+// SetMaxMatchLen limits the length, in bytes, of the tokens that encoding
+// considers, bounding the work done at each position of the input. Longer
+// tokens are never matched, even if that produces more tokens than usual.
+// A limit of zero or less removes the limit, which is the default.
+func (t *Tokenizer) SetMaxMatchLen(n int) {
+	t.maxMatchLen = n
+}
+
+// limit returns data truncated to the maximum match length from index n.
+func (t *Tokenizer) limit(data []byte, n int) []byte {
+	if t.maxMatchLen > 0 && len(data)-n > t.maxMatchLen {
+		return data[:n+t.maxMatchLen]
+	}
+	return data
+}
+
+func (t *Tokenizer) findLongest(data []byte, n int) (endIndex, value int) {
+	return t.trie.FindLongest(t.limit(data, n), n)
+}
+
+func (t *Tokenizer) findAll(data []byte, n int, fn func(endIndex, value int)) {
+	t.trie.FindAll(t.limit(data, n), n, fn)
+}
+
+// SetMaxInputBytes limits the size of the input that Encode, EncodeString,
+// EncodeInt32, EncodeInt32Into, EncodeFunc, EncodePrefix and
+// EncodeStringBuffered accept to n bytes. Larger input is rejected with
+// ErrInputTooLarge before any of it is encoded. This guards services that
+// encode untrusted text against excessive memory and CPU use. A limit of
+// zero or less removes the limit, which is the default.
+func (t *Tokenizer) SetMaxInputBytes(n int) {
+	t.maxInputBytes = n
+}
+
+// SetRejectReplacementChar sets whether the methods that SetMaxInputBytes
+// applies to reject input containing the Unicode replacement character
+// U+FFFD with ErrReplacementChar, for pipelines where it signals text that
+// was corrupted by lossy decoding upstream. By default, it is encoded like
+// any other character.
+func (t *Tokenizer) SetRejectReplacementChar(enabled bool) {
+	t.rejectFFFD = enabled
+}
+
+// checkInput returns ErrInputTooLarge if data exceeds the maximum input
+// size, or ErrReplacementChar if it contains a rejected replacement
+// character.
+func (t *Tokenizer) checkInput(data []byte) error {
+	if t.maxInputBytes > 0 && len(data) > t.maxInputBytes {
+		return ErrInputTooLarge
+	}
+	if t.rejectFFFD && bytes.Contains(data, []byte(string(utf8.RuneError))) {
+		return ErrReplacementChar
+	}
+	return nil
+}
+
+// SetAddPrefixSpace sets whether Encode prepends a space to input that does
+// not already begin with whitespace, so that the first word is encoded the
+// same way as a word in the middle of a sentence. When enabled, the decode
+// methods strip a single leading space from their output to undo this.
+// Note that this also strips a space that was present in the original
+// input.
+func (t *Tokenizer) SetAddPrefixSpace(enabled bool) {
+	t.addPrefixSpace = enabled
+}
+
+// needsPrefixSpace reports whether a space should be prepended to data
+// before encoding.
+func (t *Tokenizer) needsPrefixSpace(data []byte) bool {
+	if !t.addPrefixSpace || len(data) == 0 {
+		return false
+	}
+	r, _ := utf8.DecodeRune(data)
+	return !unicode.IsSpace(r)
+}
+
+// SetNormalizeNewlines sets whether the encode methods convert each CRLF
+// and lone CR in their input to LF before encoding, so that text with
+// Windows or old Mac line endings encodes the same as text with Unix line
+// endings. This changes the token counts of such text, and since the
+// original line endings cannot be recovered by decoding, it should not be
+// used for data where they matter. It is not applied by CountReader.
+func (t *Tokenizer) SetNormalizeNewlines(enabled bool) {
+	t.normNewlines = enabled
+}
+
+// normalizeNewlines returns data with line endings converted to LF if
+// newline normalization is enabled. data itself is never modified.
+func (t *Tokenizer) normalizeNewlines(data []byte) []byte {
+	if !t.normNewlines || bytes.IndexByte(data, '\r') < 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == '\r' {
+			c = '\n'
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// prepareInput applies newline normalization and the prefix space to data
+// before encoding.
+func (t *Tokenizer) prepareInput(data []byte) []byte {
+	data = t.normalizeNewlines(data)
+	if t.needsPrefixSpace(data) {
+		data = append([]byte{' '}, data...)
+	}
+	return data
+}
+
+// SetDecodeFilter sets a function that Decode, DecodeInto and
+// DecodeToString apply to their decoded text before returning it, or
+// removes the filter if fn is nil. The filter is not applied by
+// DecodeWithOffsets, DecodeToWriter or NewTextReader.
+func (t *Tokenizer) SetDecodeFilter(fn func(string) string) {
+	t.decodeFilter = fn
+}
+
+// SetDocumentSeparator makes the encode methods treat every occurrence of the
+// byte sep as a hard boundary between documents. Each document is encoded on
+// its own, so no token is ever matched across a separator, and the separator
+// itself is encoded as sepTokenID. If prefix spaces are enabled, they are
+// added to each document separately. A negative sepTokenID removes the
+// separator, which is the default. EncodePieces, EncodeSegments, Encoder and
+// CountReader do not split documents.
+//
+// This allows a whole corpus of NUL-separated documents to be encoded in one
+// call by passing 0 as the separator.
+func (t *Tokenizer) SetDocumentSeparator(sep byte, sepTokenID int) {
+	t.docSep, t.docSepID = sep, sepTokenID
+}
+
+// IsTotal reports whether the vocabulary contains a single-byte token for
+// every possible byte value. If it does, Encode cannot fail with
+// ErrCannotTokenize, though it can still reject input as configured by
+// SetMaxInputBytes and SetRejectReplacementChar.
+func (t *Tokenizer) IsTotal() bool {
+	for c := 0; c < 256; c++ {
+		child := t.trie.child(byte(c))
+		if child == nil || child.value == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode encodes the given byte slice into an int slice of tokens.
+//
+// Tokens are matched greedily: at each position, the longest token that
+// matches the input there is chosen, and matching continues after it. There
+// is no backtracking, so a shorter match is never preferred in order to
+// allow a longer match later on.
+func (t *Tokenizer) Encode(data []byte) (tokens []int, err error) {
+	if err := t.checkInput(data); err != nil {
+		return nil, err
+	}
+	return t.encodeDocuments(make([]int, 0, 32), data)
+}
+
+// splitDocument splits the first document off data, returning it prepared
+// for encoding along with the rest of data after the separator that ends it.
+// more reports whether there was such a separator, and so another document
+// after it, whose separator token goes between the two. If no document
+// separator is set, all of data is one document.
+func (t *Tokenizer) splitDocument(data []byte) (doc, rest []byte, more bool) {
+	doc = data
+	if t.docSepID >= 0 {
+		if i := bytes.IndexByte(data, t.docSep); i >= 0 {
+			doc, rest, more = data[:i], data[i+1:], true
+		}
+	}
+	return t.prepareInput(doc), rest, more
+}
+
+// encodeDocuments encodes each document of data and appends the tokens to
+// tokens, with the separator token between documents. It is the core of
+// Encode, which the other encode methods follow.
+func (t *Tokenizer) encodeDocuments(tokens []int, data []byte) ([]int, error) {
+	for more := true; more; {
+		var doc []byte
+		var err error
+		doc, data, more = t.splitDocument(data)
+		if tokens, err = t.encodeAppend(tokens, doc); err != nil {
+			return tokens, err
+		}
+		if more {
+			tokens = append(tokens, t.docSepID)
+		}
+	}
+	return tokens, nil
+}
+
+// encodeAppend encodes data and appends the tokens to tokens. Unlike Encode,
+// it never adds a prefix space.
+func (t *Tokenizer) encodeAppend(tokens []int, data []byte) ([]int, error) {
+	if t.asciiTrie != nil && t.maxMatchLen <= 0 && isASCII(data) {
+		return t.encodeASCII(tokens, data)
+	}
+
+	n := 0
+	for n < len(data) {
+		var ok bool
+		if tokens, n, ok = t.matchNext(tokens, data, n); !ok {
+			return tokens, ErrCannotTokenize
+		}
+	}
+	return tokens, nil
+}
+
+// matchNext appends the longest token matching data at index n to tokens and
+// returns the index following it, using the fallback if no token matches. It
+// returns false if there is no fallback either.
+func (t *Tokenizer) matchNext(tokens []int, data []byte, n int) ([]int, int, bool) {
+	n2, id := t.findLongest(data, n)
+	if n2 == n || id == -1 {
+		return t.fallback(tokens, data, n)
+	}
+	return append(tokens, id), n2, true
+}
+
+// fallback is called when no token matches data at index n. It appends
+// replacement tokens for the unmatched input to tokens and returns the
+// index following it, or returns false if there is no fallback.
+//
+// If there is a fallback tokenizer, its longest match is used. Otherwise a
+// single byte is replaced with the unknown token ID. With rune fallback
+// enabled, all the bytes of the UTF-8 character at n are replaced at once,
+// each with its single-byte token if there is one.
+func (t *Tokenizer) fallback(tokens []int, data []byte, n int) ([]int, int, bool) {
+	if t.fallbackTkn != nil {
+		if n2, id := t.fallbackMatch(data, n); id != -1 {
+			return append(tokens, id), n2, true
+		}
+	}
+
+	size := 1
+	if t.runeFallback {
+		_, size = utf8.DecodeRune(data[n:])
+	}
+
+	start := len(tokens)
+	for _, c := range data[n : n+size] {
+		if child := t.trie.child(c); child != nil && child.value != -1 {
+			tokens = append(tokens, child.value)
+		} else if t.unknownID >= 0 {
+			tokens = append(tokens, t.unknownID)
+		} else {
+			return tokens[:start], n, false
+		}
+	}
+	return tokens, n + size, true
+}
+
+// EncodeInt32 encodes the given byte slice into an int32 slice of tokens,
+// as expected by many tensor libraries. It returns ErrIDOutOfRange if a
+// token ID does not fit in an int32.
+func (t *Tokenizer) EncodeInt32(data []byte) (tokens []int32, err error) {
+	return t.EncodeInt32Into(make([]int32, 0, 32), data)
+}
+
+// EncodeInt32Into is like EncodeInt32, but appends the tokens to dst and
+// returns the extended slice. Reusing dst across calls avoids allocating
+// for each encode once it has grown large enough.
+func (t *Tokenizer) EncodeInt32Into(dst []int32, data []byte) (tokens []int32, err error) {
+	if err := t.checkInput(data); err != nil {
+		return dst, err
+	}
+
+	var scratch [utf8.UTFMax]int
+	tokens = dst
+	for more := true; more; {
+		var doc []byte
+		doc, data, more = t.splitDocument(data)
+		for n := 0; n < len(doc); {
+			ids, n2, ok := t.matchNext(scratch[:0], doc, n)
+			if !ok {
+				return tokens, ErrCannotTokenize
+			}
+			if tokens, err = appendInt32(tokens, ids...); err != nil {
+				return
+			}
+			n = n2
+		}
+		if more {
+			if tokens, err = appendInt32(tokens, t.docSepID); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// appendInt32 appends ids to tokens, returning ErrIDOutOfRange if one does
+// not fit in an int32.
+func appendInt32(tokens []int32, ids ...int) ([]int32, error) {
+	for _, id := range ids {
+		if id < math.MinInt32 || id > math.MaxInt32 {
+			return tokens, ErrIDOutOfRange
+		}
+		tokens = append(tokens, int32(id))
+	}
+	return tokens, nil
+}
+
+// HealAndEncode performs token healing: it removes the last token of prefix
+// and re-encodes its bytes together with continuation, so that the boundary
+// between the two is tokenized as it would be had the text been encoded in
+// one piece. It returns the remaining prefix tokens followed by the new
+// tokens. The prefix slice itself is not modified. If prefix is empty,
+// continuation is encoded as by Encode, with the prefix space; otherwise it
+// is only newline-normalized, as it continues the text.
+func (t *Tokenizer) HealAndEncode(prefix []int, continuation []byte) ([]int, error) {
+	if len(prefix) == 0 {
+		return t.encodeAppend(make([]int, 0, 32), t.prepareInput(continuation))
+	}
+	continuation = t.normalizeNewlines(continuation)
+
+	last, ok := t.vocabToken(prefix[len(prefix)-1])
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+
+	data := make([]byte, 0, len(last)+len(continuation))
+	data = append(append(data, last...), continuation...)
+
+	tokens := make([]int, len(prefix)-1, len(prefix)+32)
+	copy(tokens, prefix)
+	return t.encodeAppend(tokens, data)
+}
+
+// Recombine canonicalizes a token stream by decoding it and encoding the
+// result again, so that runs of tokens, such as single-byte tokens, that
+// spell out a longer token in the vocabulary are replaced by it. It returns
+// ErrUnknownToken if tokens contains an unknown ID.
+func (t *Tokenizer) Recombine(tokens []int) ([]int, error) {
+	var data []byte
+	for _, v := range tokens {
+		tokStr, ok := t.vocabToken(v)
+		if !ok {
+			return nil, ErrUnknownToken
+		}
+		data = append(data, tokStr...)
+	}
+	return t.encodeAppend(make([]int, 0, len(tokens)), data)
+}
+
+// EncodeAvoiding encodes the given byte slice into an int slice of tokens
+// that contains none of the token IDs in forbidden. If the usual greedy
+// encoding contains no forbidden token, it is returned unchanged. Otherwise
+// EncodeAvoiding returns the segmentation with the fewest tokens among those
+// avoiding forbidden, preferring longer tokens earlier in the input when
+// there are several. ErrCannotTokenize is returned if no such segmentation
+// exists, which includes input with a document separator whose token is
+// forbidden. Input rejected by Encode is rejected with the same error.
+func (t *Tokenizer) EncodeAvoiding(data []byte, forbidden map[int]bool) ([]int, error) {
+	if err := t.checkInput(data); err != nil {
+		return nil, err
+	}
+
+	tokens, err := t.Encode(data)
+	if err != nil && err != ErrCannotTokenize {
+		return nil, err
+	} else if err == nil {
+		ok := true
+		for _, v := range tokens {
+			if forbidden[v] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return tokens, nil
+		}
+	}
+
+	tokens = make([]int, 0, len(tokens))
+	for more := true; more; {
+		var doc []byte
+		doc, data, more = t.splitDocument(data)
+		if tokens, err = t.encodeAvoidingDocument(tokens, doc, forbidden); err != nil {
+			return nil, err
+		}
+		if more {
+			if forbidden[t.docSepID] {
+				return nil, ErrCannotTokenize
+			}
+			tokens = append(tokens, t.docSepID)
+		}
+	}
+	return tokens, nil
+}
+
+// encodeAvoidingDocument appends to tokens the segmentation of data chosen
+// by EncodeAvoiding, or returns ErrCannotTokenize if there is none. Where no
+// token that is not forbidden matches, the fallback tokens are used as they
+// would be by Encode where no token matches.
+func (t *Tokenizer) encodeAvoidingDocument(tokens []int, data []byte, forbidden map[int]bool) ([]int, error) {
+	// cost[i] is the fewest tokens needed to encode data[i:], or -1 if it
+	// cannot be encoded; next[i] and ids[i] record the first token used, with
+	// an ID of -1 standing for the fallback tokens at i.
+	var scratch [utf8.UTFMax]int
+	cost := make([]int, len(data)+1)
+	next := make([]int, len(data))
+	ids := make([]int, len(data))
+	for i := len(data) - 1; i >= 0; i-- {
+		cost[i] = -1
+		consider := func(endIndex, count, value int) {
+			if cost[endIndex] == -1 {
+				return
+			}
+			if c := cost[endIndex] + count; cost[i] == -1 || c <= cost[i] {
+				cost[i], next[i], ids[i] = c, endIndex, value
+			}
+		}
+
+		matched := false
+		t.findAll(data, i, func(endIndex, value int) {
+			if !forbidden[value] {
+				matched = true
+				consider(endIndex, 1, value)
+			}
+		})
+		if matched {
+			continue
+		}
+		if fallback, endIndex, ok := t.fallback(scratch[:0], data, i); ok {
+			for _, v := range fallback {
+				ok = ok && !forbidden[v]
+			}
+			if ok {
+				consider(endIndex, len(fallback), -1)
+			}
+		}
+	}
+
+	if cost[0] == -1 {
+		return tokens, ErrCannotTokenize
+	}
+	for i := 0; i < len(data); i = next[i] {
+		if ids[i] == -1 {
+			tokens, _, _ = t.fallback(tokens, data, i)
+		} else {
+			tokens = append(tokens, ids[i])
+		}
+	}
+	return tokens, nil
+}
+
+// ExplainEncode returns a human-readable trace of how text is encoded. For
+// each position in the input, it lists every token that matches there and
+// marks the longest one, which is the token Encode chooses.
+func (t *Tokenizer) ExplainEncode(text string) string {
+	data := t.prepareInput([]byte(text))
+
+	var b strings.Builder
+	n := 0
+	for n < len(data) {
+		fmt.Fprintf(&b, "%d:", n)
+		n2, id := t.findLongest(data, n)
+		t.findAll(data, n, func(endIndex, value int) {
+			mark := ""
+			if endIndex == n2 {
+				mark = "*"
+			}
+			fmt.Fprintf(&b, " %s%q(%d)", mark, data[n:endIndex], value)
+		})
+
+		if n2 == n || id == -1 {
+			var ids []int
+			var ok bool
+			if ids, n2, ok = t.fallback(nil, data, n); !ok {
+				fmt.Fprintf(&b, " no match for byte %#02x\n", data[n])
+				break
+			}
+			fmt.Fprintf(&b, " *fallback%v", ids)
+		}
+		b.WriteByte('\n')
+		n = n2
+	}
+	return b.String()
+}
+
+// EncodeFunc encodes data, calling emit for each token as it is matched
+// instead of building a slice. If emit returns an error, encoding stops and
+// EncodeFunc returns that error. If data cannot be tokenized, EncodeFunc
+// returns ErrCannotTokenize after emitting the tokens before that point.
+func (t *Tokenizer) EncodeFunc(data []byte, emit func(id int) error) error {
+	if err := t.checkInput(data); err != nil {
+		return err
+	}
+
+	var scratch [utf8.UTFMax]int
+	for more := true; more; {
+		var doc []byte
+		doc, data, more = t.splitDocument(data)
+		for n := 0; n < len(doc); {
+			ids, n2, ok := t.matchNext(scratch[:0], doc, n)
+			if !ok {
+				return ErrCannotTokenize
+			}
+			for _, id := range ids {
+				if err := emit(id); err != nil {
+					return err
+				}
+			}
+			n = n2
+		}
+		if more {
+			if err := emit(t.docSepID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EncodePrefix is like Encode, but for data that is known to be followed by
+// more input. It also reports whether the final tokens could change once more
+// input arrives, because the input from the start of one of them onward is a
+// proper prefix of a longer token. This is usually because the last token
+// could be extended, as when data ends with "Hel", but can also be because
+// the last few tokens could merge into one. If lastMayExtend is false, the
+// tokens are the same as those at the start of the encoding of any longer
+// input beginning with data. Only the last document of data can be extended.
+func (t *Tokenizer) EncodePrefix(data []byte) (tokens []int, lastMayExtend bool, err error) {
+	if err := t.checkInput(data); err != nil {
+		return nil, false, err
+	}
+	tokens = make([]int, 0, 32)
+	for more := true; more; {
+		var doc []byte
+		doc, data, more = t.splitDocument(data)
+		lastMayExtend = false
+		for n := 0; n < len(doc); {
+			if !lastMayExtend {
+				lastMayExtend = t.couldExtendToken(doc[n:])
+			}
+
+			var ok bool
+			if tokens, n, ok = t.matchNext(tokens, doc, n); !ok {
+				return tokens, false, ErrCannotTokenize
+			}
+		}
+		if more {
+			tokens = append(tokens, t.docSepID)
+		}
+	}
+	return tokens, lastMayExtend, nil
+}
+
+// EncodePieces encodes data and returns the bytes matched by each token,
+// as subslices of data rather than copies. Tokens that replace unmatched
+// input each cover a single byte, except for tokens of the fallback
+// tokenizer. Neither the prefix space nor newline
+// normalization is applied, so that the pieces concatenate to data. If data
+// cannot be tokenized, EncodePieces returns ErrCannotTokenize along with the
+// pieces before that point.
+func (t *Tokenizer) EncodePieces(data []byte) ([][]byte, error) {
+	var scratch [utf8.UTFMax]int
+	pieces := make([][]byte, 0, 32)
+	n := 0
+	for n < len(data) {
+		ids, n2, ok := t.matchNext(scratch[:0], data, n)
+		if !ok {
+			return pieces, ErrCannotTokenize
+		}
+		if len(ids) == 1 {
+			pieces = append(pieces, data[n:n2:n2])
+		} else {
+			for i := n; i < n2; i++ {
+				pieces = append(pieces, data[i:i+1:i+1])
+			}
+		}
+		n = n2
+	}
+	return pieces, nil
+}
+
+// EncodeString encodes the given string into an int slice of tokens.
+func (t *Tokenizer) EncodeString(text string) (tokens []int, err error) {
+	return t.Encode([]byte(text))
+}
+
+// EncodeUntil encodes the part of text before the first occurrence of stop,
+// and reports whether stop occurs in text. Since only that part is encoded,
+// no token extends into stop, even where a token would otherwise span the
+// boundary. If stop is not found, the whole of text is encoded. An empty stop
+// is found at the start of text.
+func (t *Tokenizer) EncodeUntil(text, stop string) (tokens []int, found bool, err error) {
+	if i := strings.Index(text, stop); i >= 0 {
+		text, found = text[:i], true
+	}
+	tokens, err = t.EncodeString(text)
+	return tokens, found, err
+}
+
+// PrepareEncode builds a flattened copy of the part of the trie that ASCII
+// text can reach, which speeds up encoding input that consists only of ASCII
+// bytes, such as most English text and source code. The results are the
+// same as without it. For the World vocabulary, the copy takes about 46 MB.
+// It is discarded when tokens are added, so PrepareEncode must be called
+// again after changing the vocabulary.
+func (t *Tokenizer) PrepareEncode() {
+	t.asciiTrie = buildASCIITrie(t.trie)
+}
+
+type decodeEntry struct {
+	token string
+	ok    bool
+}
+
+// PrepareDecode builds a lookup table that speeds up decoding by avoiding
+// map lookups for all but the largest token IDs. The table is kept up to
+// date as tokens are added, but tokens whose IDs fall outside it are only
+// included by calling PrepareDecode again.
+func (t *Tokenizer) PrepareDecode() {
+	size, limit := 0, 2*len(t.i2t)+256
+	for id := range t.i2t {
+		if id >= size && id < limit {
+			size = id + 1
+		}
+	}
+
+	t.decodeTable = make([]decodeEntry, size)
+	for id, token := range t.i2t {
+		if id >= 0 && id < size {
+			t.decodeTable[id] = decodeEntry{token, true}
+		}
+	}
+}
+
+func (t *Tokenizer) setDecodeEntry(id int, token string, ok bool) {
+	if id >= 0 && id < len(t.decodeTable) {
+		t.decodeTable[id] = decodeEntry{token, ok}
+	}
+}
+
+// lookup returns the token for the given ID.
+func (t *Tokenizer) lookup(id int) (string, bool) {
+	if id >= 0 && id < len(t.decodeTable) {
+		e := t.decodeTable[id]
+		return e.token, e.ok
+	}
+	token, ok := t.i2t[id]
+	return token, ok
+}
+
+// vocabToken is like lookup, but also accepts IDs of the fallback tokenizer,
+// so that it accepts every ID that encoding can produce.
+func (t *Tokenizer) vocabToken(id int) (string, bool) {
+	if token, ok := t.lookup(id); ok {
+		return token, true
+	}
+	if t.fallbackTkn != nil && id >= t.fallbackOffset {
+		return t.fallbackTkn.vocabToken(id - t.fallbackOffset)
+	}
+	return "", false
+}
+
+// decodeToken is like lookup, but also accepts reserved IDs, returning the
+// reserved placeholder for them, and IDs of the fallback tokenizer. It is used
+// by the decode methods.
+func (t *Tokenizer) decodeToken(id int) (string, bool) {
+	if token, ok := t.lookup(id); ok {
+		return token, true
+	}
+	if t.reserved[id] {
+		return t.reservedPlaceholder, true
+	}
+	if t.fallbackTkn != nil && id >= t.fallbackOffset {
+		return t.fallbackTkn.decodeToken(id - t.fallbackOffset)
+	}
+	return "", false
+}
+
+// Decode decodes an int slice of tokens to a byte slice.
+func (t *Tokenizer) Decode(tokens []int) (data []byte, err error) {
+	var b bytes.Buffer
+	for _, v := range tokens {
+		if tokStr, ok := t.decodeToken(v); ok {
+			b.WriteString(tokStr)
+		} else {
+			err = ErrUnknownToken
+		}
+	}
+	data = b.Bytes()
+	if t.addPrefixSpace && len(data) > 0 && data[0] == ' ' {
+		data = data[1:]
+	}
+	if t.decodeFilter != nil {
+		data = []byte(t.decodeFilter(string(data)))
+	}
+	return
+}
+
+// DecodeInto decodes an int slice of tokens, appending the result to dst
+// and returning the extended slice. Reusing dst across calls avoids
+// allocating a new buffer for each decode.
+func (t *Tokenizer) DecodeInto(dst []byte, tokens []int) (data []byte, err error) {
+	data = dst
+	for _, v := range tokens {
+		if tokStr, ok := t.decodeToken(v); ok {
+			data = append(data, tokStr...)
+		} else {
+			err = ErrUnknownToken
+		}
+	}
+	if t.addPrefixSpace && len(data) > len(dst) && data[len(dst)] == ' ' {
+		data = append(data[:len(dst)], data[len(dst)+1:]...)
+	}
+	if t.decodeFilter != nil {
+		data = append(data[:len(dst)], t.decodeFilter(string(data[len(dst):]))...)
+	}
+	return
+}
+
+// DecodeToString decodes an int slice of tokens to a string.
+func (t *Tokenizer) DecodeToString(tokens []int) (text string, err error) {
+	var b strings.Builder
+	for _, v := range tokens {
+		if tokStr, ok := t.decodeToken(v); ok {
+			b.WriteString(tokStr)
+		} else {
+			err = ErrUnknownToken
+		}
+	}
+	text = b.String()
+	if t.addPrefixSpace && len(text) > 0 && text[0] == ' ' {
+		text = text[1:]
+	}
+	if t.decodeFilter != nil {
+		text = t.decodeFilter(text)
+	}
+	return
+}
+
+// DecodeRange decodes tokens[i:j] to a string, as when rendering a window of
+// a long token stream. It returns ErrInvalidRange if the range is not within
+// tokens. The output buffer is sized exactly before decoding, so only the
+// decoded range is allocated. A prefix space is only stripped if i is zero,
+// since only the first token of the stream can hold one.
+func (t *Tokenizer) DecodeRange(tokens []int, i, j int) (text string, err error) {
+	if i < 0 || j < i || j > len(tokens) {
+		return "", ErrInvalidRange
+	}
+	tokens = tokens[i:j]
+
+	size := 0
+	for _, v := range tokens {
+		tokStr, _ := t.decodeToken(v)
+		size += len(tokStr)
+	}
+
+	var b strings.Builder
+	b.Grow(size)
+	for _, v := range tokens {
+		if tokStr, ok := t.decodeToken(v); ok {
+			b.WriteString(tokStr)
+		} else {
+			err = ErrUnknownToken
+		}
+	}
+	text = b.String()
+	if i == 0 && t.addPrefixSpace && len(text) > 0 && text[0] == ' ' {
+		text = text[1:]
+	}
+	if t.decodeFilter != nil {
+		text = t.decodeFilter(text)
+	}
+	return
+}
+
+// DecodeToWriter decodes an int slice of tokens, writing the result to w,
+// and returns the number of bytes written. If strict is true, decoding stops
+// at the first unknown token; otherwise unknown tokens are skipped. In both
+// cases ErrUnknownToken is returned if an unknown token was seen, unless
+// writing to w fails.
+func (t *Tokenizer) DecodeToWriter(w io.Writer, tokens []int, strict bool) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	start := t.addPrefixSpace
+	for _, v := range tokens {
+		tokStr, ok := t.decodeToken(v)
+		if !ok {
+			err = ErrUnknownToken
+			if strict {
+				break
+			}
+			continue
+		}
+
+		if start && len(tokStr) > 0 {
+			if tokStr[0] == ' ' {
+				tokStr = tokStr[1:]
+			}
+			start = false
+		}
+
+		nn, werr := bw.WriteString(tokStr)
+		n += nn
+		if werr != nil {
+			return n, werr
+		}
+	}
+
+	if werr := bw.Flush(); werr != nil {
+		return n - bw.Buffered(), werr
+	}
+	return
+}
+
+// DecodeWithOffsets decodes an int slice of tokens to a string, and also
+// returns the byte range [start, end) that each token occupies in it, so
+// that text[offsets[i][0]:offsets[i][1]] is the text of tokens[i]. Unknown
+// tokens are given an empty range.
+func (t *Tokenizer) DecodeWithOffsets(tokens []int) (text string, offsets [][2]int, err error) {
+	var b strings.Builder
+	offsets = make([][2]int, len(tokens))
+	for i, v := range tokens {
+		start := b.Len()
+		if tokStr, ok := t.decodeToken(v); ok {
+			b.WriteString(tokStr)
+		} else {
+			err = ErrUnknownToken
+		}
+		offsets[i] = [2]int{start, b.Len()}
+	}
+	text = b.String()
+	if t.addPrefixSpace && len(text) > 0 && text[0] == ' ' {
+		text = text[1:]
+		for i := range offsets {
+			offsets[i][0] = max(offsets[i][0]-1, 0)
+			offsets[i][1] = max(offsets[i][1]-1, 0)
+		}
+	}
+	return
+}
+
+// DecodeTokens returns the token for each ID in tokens. The strings are the
+// ones held by the vocabulary, so no token is copied and only the result
+// slice is allocated. Unknown IDs give an empty string and make DecodeTokens
+// return ErrUnknownToken. Neither the prefix space nor the decode filter is
+// applied.
+func (t *Tokenizer) DecodeTokens(tokens []int) (pieces []string, err error) {
+	pieces = make([]string, len(tokens))
+	for i, v := range tokens {
+		if tokStr, ok := t.decodeToken(v); ok {
+			pieces[i] = tokStr
+		} else {
+			err = ErrUnknownToken
+		}
+	}
+	return
+}
+
+// ANSI escape sequences used by DecodeColored.
+const (
+	ansiReset = "\x1b[0m"
+	ansiBlack = "\x1b[30m"
+)
+
+// ansiBackgrounds are the background colors that DecodeColored alternates
+// between.
+var ansiBackgrounds = [...]string{"\x1b[46m", "\x1b[43m"}
+
+// DecodeColored decodes tokens for display in a terminal, wrapping each
+// token in ANSI escape sequences that alternate its background color, so
+// that the token boundaries can be seen. Each token is followed by a reset
+// sequence. Characters that are not printable, including line breaks, tabs
+// and bytes that do not form valid UTF-8, are shown escaped as in a Go string
+// literal. Neither the prefix space nor the decode filter is applied, and
+// unknown IDs make DecodeColored return ErrUnknownToken.
+func (t *Tokenizer) DecodeColored(tokens []int) (string, error) {
+	var b strings.Builder
+	for i, v := range tokens {
+		tokStr, ok := t.decodeToken(v)
+		if !ok {
+			return b.String(), ErrUnknownToken
+		}
+
+		b.WriteString(ansiBackgrounds[i%len(ansiBackgrounds)])
+		b.WriteString(ansiBlack)
+		for len(tokStr) > 0 {
+			r, size := utf8.DecodeRuneInString(tokStr)
+			if r == utf8.RuneError && size == 1 {
+				fmt.Fprintf(&b, "\\x%02x", tokStr[0])
+			} else if unicode.IsPrint(r) {
+				b.WriteString(tokStr[:size])
+			} else {
+				q := strconv.QuoteRune(r)
+				b.WriteString(q[1 : len(q)-1])
+			}
+			tokStr = tokStr[size:]
+		}
+		b.WriteString(ansiReset)
+	}
+	return b.String(), nil
+}
+
+// ValidateIDs checks that every token ID in tokens is in the vocabulary or
+// that of the fallback tokenizer. It returns the index of the first unknown
+// ID, or -1 and true if there is none, so that untrusted input can be
+// rejected before decoding. Reserved IDs are unknown.
+func (t *Tokenizer) ValidateIDs(tokens []int) (badIndex int, ok bool) {
+	for i, v := range tokens {
+		if _, ok := t.vocabToken(v); !ok {
+			return i, false
+		}
+	}
+	return -1, true
+}
+
+// TokenToID returns the ID of the specified token.
+func (t *Tokenizer) TokenToID(token string) (int, error) {
+	if id, ok := t.t2i[token]; ok {
+		return id, nil
+	} else {
+		return -1, ErrCannotTokenize
+	}
+}
+
+// IDToToken returns the token for the given ID, which may be an ID of the
+// fallback tokenizer.
+func (t *Tokenizer) IDToToken(id int) (string, error) {
+	if token, ok := t.vocabToken(id); ok {
+		return token, nil
+	} else {
+		return "", ErrUnknownToken
+	}
+}
+
+// HasDuplicateTokens reports whether several IDs in the vocabulary share the
+// same token, in which case those IDs decode identically and only one of
+// them is ever produced by encoding. It also returns each group of IDs that
+// share a token, with the IDs in ascending order and the groups ordered by
+// their smallest ID.
+func (t *Tokenizer) HasDuplicateTokens() (bool, [][]int) {
+	ids := make(map[string][]int)
+	for id, token := range t.i2t {
+		if canonical, ok := t.t2i[token]; ok && canonical != id {
+			ids[token] = append(ids[token], id)
+		}
+	}
+
+	groups := make([][]int, 0, len(ids))
+	for token, group := range ids {
+		group = append(group, t.t2i[token])
+		sort.Ints(group)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return len(groups) > 0, groups
+}
+
+// ValidNextTokens returns the IDs of all tokens that begin with prefixBytes,
+// including a token equal to it, in ascending order. These are the tokens
+// that can complete a partially generated token whose bytes so far are
+// prefixBytes, as needed for constrained generation. It returns
+// ErrCannotTokenize if no token begins with prefixBytes.
+func (t *Tokenizer) ValidNextTokens(prefixBytes []byte) ([]int, error) {
+	node := t.trie.node(prefixBytes)
+	if node == nil {
+		return nil, ErrCannotTokenize
+	}
+
+	var ids []int
+	node.eachValue(func(id int) {
+		ids = append(ids, id)
+	})
+	if len(ids) == 0 {
+		return nil, ErrCannotTokenize
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// IDRange returns the smallest and largest token IDs in the vocabulary. If
+// the vocabulary is empty, it returns 0 and -1, so that max-min+1 is zero.
+func (t *Tokenizer) IDRange() (min, max int) {
+	if len(t.i2t) == 0 {
+		return 0, -1
+	}
+	first := true
+	for id := range t.i2t {
+		if first || id < min {
+			min = id
+		}
+		if first || id > max {
+			max = id
+		}
+		first = false
+	}
+	return min, max
+}
+
+// mapEntryOverhead is the approximate per-entry bookkeeping cost of a Go
+// map, excluding the key and value themselves.
+const mapEntryOverhead = 16
+
+// ApproxMemoryBytes returns a rough estimate of the memory, in bytes, used
+// by the Tokenizer's trie and vocabulary maps.
+func (t *Tokenizer) ApproxMemoryBytes() int64 {
+	entrySize := int64(unsafe.Sizeof("")+unsafe.Sizeof(0)) + mapEntryOverhead
+
+	n := t.trie.MemSize()
+	for token := range t.t2i {
+		n += int64(len(token)) + entrySize
+	}
+	n += int64(len(t.i2t)) * entrySize
+	return n
+}
+
+// IDToBytes returns the token for the given ID as a byte slice. Unlike
+// IDToToken, the result makes no assumption that the token is valid UTF-8.
+func (t *Tokenizer) IDToBytes(id int) ([]byte, error) {
+	if token, ok := t.vocabToken(id); ok {
+		return []byte(token), nil
+	} else {
+		return nil, ErrUnknownToken
+	}
+}
+
+// IsCompleteUTF8 reports whether the token with the given ID consists only
+// of complete, valid UTF-8 characters. It returns false for tokens holding
+// part of a multi-byte character, and for unknown IDs. IDs of the fallback
+// tokenizer are known.
+func (t *Tokenizer) IsCompleteUTF8(id int) bool {
+	token, ok := t.vocabToken(id)
+	return ok && utf8.ValidString(token)
+}
+
+// Kind is the classification of a token in the vocabulary.
+type Kind int
+
+const (
+	// KindByte is a token consisting of a single byte, or of a byte sequence
+	// that is not valid UTF-8.
+	KindByte Kind = iota
+	// KindText is a multi-byte token that is valid UTF-8.
+	KindText
+	// KindSpecial is a token added with AddSpecialToken.
+	KindSpecial
+	// KindReserved is an ID reserved with ReserveIDs that has no token.
+	KindReserved
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindByte:
+		return "byte"
+	case KindText:
+		return "text"
+	case KindSpecial:
+		return "special"
+	case KindReserved:
+		return "reserved"
+	default:
+		return "Kind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// TokenKind returns the classification of the token with the given ID. IDs
+// of the fallback tokenizer are classified as by it.
+func (t *Tokenizer) TokenKind(id int) (Kind, error) {
+	token, ok := t.lookup(id)
+	switch {
+	case !ok && t.reserved[id]:
+		return KindReserved, nil
+	case !ok && t.fallbackTkn != nil && id >= t.fallbackOffset:
+		return t.fallbackTkn.TokenKind(id - t.fallbackOffset)
+	case !ok:
+		return 0, ErrUnknownToken
+	case t.special[id]:
+		return KindSpecial, nil
+	case len(token) == 1 || !utf8.ValidString(token):
+		return KindByte, nil
+	default:
+		return KindText, nil
 	}
 }
@@ -1,7 +1,19 @@
 package rwkvtkn
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"unsafe"
 )
 
 func intSliceEquals(a, b []int) bool {
@@ -17,10 +29,19 @@ func intSliceEquals(a, b []int) bool {
 	return true
 }
 
+// newWorldTokenizer returns a Tokenizer with the default vocabulary, or
+// skips the test if the package was built without it.
+func newWorldTokenizer(tb testing.TB) *Tokenizer {
+	if rwkvVocab20230424 == nil {
+		tb.Skip("built without the embedded World vocabulary")
+	}
+	return NewWorldTokenizer()
+}
+
 // TestSimpleRoundtrip tests the creation of a tokenizer with the
 // default vocabulary and round-tripping a unicode string.
 func TestSimpleRoundtrip(t *testing.T) {
-	tkn := NewWorldTokenizer()
+	tkn := newWorldTokenizer(t)
 
 	s := "Hello, world! こんにちは、世界！"
 	i := []int{33155, 45, 40213, 34, 33, 10115, 10165, 10136, 10127, 10139, 10079, 10267, 14610, 19126}
@@ -35,3 +56,1717 @@ func TestSimpleRoundtrip(t *testing.T) {
 		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q`, x, y, err, s)
 	}
 }
+
+// TestApproxMemoryBytes tests that the memory estimate is non-zero and
+// grows with the size of the vocabulary.
+func TestApproxMemoryBytes(t *testing.T) {
+	small := NewTokenizer()
+	small.AddTokenString("a", 1)
+	small.AddTokenString("ab", 2)
+
+	world := newWorldTokenizer(t)
+
+	s, w := small.ApproxMemoryBytes(), world.ApproxMemoryBytes()
+	if s <= 0 || w <= s {
+		t.Fatalf(`ApproxMemoryBytes() = %d (small), %d (world), want 0 < small < world`, s, w)
+	}
+}
+
+// TestNewTokenizerFromFiles tests that a vocabulary overlay overrides an
+// entry from the base vocabulary.
+func TestNewTokenizerFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	base, overlay := filepath.Join(dir, "base.txt"), filepath.Join(dir, "overlay.txt")
+	if err := os.WriteFile(base, []byte("1 'a' 1\n2 'b' 1\n3 'ab' 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(overlay, []byte("3 'ba' 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tkn, err := NewTokenizerFromFiles(base, overlay)
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromFiles() = %v`, err)
+	}
+
+	for s, i := range map[string][]int{"ab": {1, 2}, "ba": {3}} {
+		x, err := tkn.EncodeString(s)
+		if !intSliceEquals(x, i) || err != nil {
+			t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+		}
+	}
+}
+
+// TestReassignSharedToken tests that reassigning an ID whose token another
+// ID also holds keeps the token encodable.
+func TestReassignSharedToken(t *testing.T) {
+	tkn, err := NewTokenizerFromReader(strings.NewReader("1 'a' 1\n2 'b' 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tkn.ReadFrom(strings.NewReader("3 'a' 1\n3 'c' 1\n")); err != nil {
+		t.Fatalf(`ReadFrom() = _, %v`, err)
+	}
+	if x, err := tkn.EncodeString("abc"); !intSliceEquals(x, []int{1, 2, 3}) || err != nil {
+		t.Fatalf(`EncodeString("abc") = %v, %v, want equal to [1 2 3]`, x, err)
+	}
+
+	tkn.AddTokenString("b", 4)
+	tkn.AddTokenString("d", 4)
+	if x, err := tkn.EncodeString("bd"); !intSliceEquals(x, []int{2, 4}) || err != nil {
+		t.Fatalf(`EncodeString("bd") = %v, %v, want equal to [2 4]`, x, err)
+	}
+	if id, err := tkn.TokenToID("b"); id != 2 || err != nil {
+		t.Fatalf(`TokenToID("b") = %d, %v, want equal to 2`, id, err)
+	}
+}
+
+// TestSelfTest tests that SelfTest passes with the default vocabulary and
+// fails once the vocabulary has been altered.
+func TestSelfTest(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	if err := tkn.SelfTest(); err != nil {
+		t.Fatalf(`SelfTest() = %v, want nil`, err)
+	}
+
+	tkn.AddTokenString(", world", 70000)
+	if err := tkn.SelfTest(); err != ErrSelfTestFailed {
+		t.Fatalf(`SelfTest() = %v, want %v`, err, ErrSelfTestFailed)
+	}
+}
+
+// TestIDToBytes tests retrieving a token that is not valid UTF-8.
+func TestIDToBytes(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	x, err := tkn.IDToBytes(256)
+	if !bytes.Equal(x, []byte{0xff}) || err != nil {
+		t.Fatalf(`IDToBytes(256) = %v, %v, want equal to %v`, x, err, []byte{0xff})
+	}
+
+	if _, err := tkn.IDToBytes(-1); err != ErrUnknownToken {
+		t.Fatalf(`IDToBytes(-1) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// benchmarkText is a multilingual sample repeated to roughly 1 MiB.
+var benchmarkText = []byte(strings.Repeat(
+	"The quick brown fox jumps over the lazy dog. "+
+		"Le cœur a ses raisons que la raison ne connaît point. "+
+		"Пример текста на русском языке. "+
+		"こんにちは、世界！今日はいい天気ですね。"+
+		"你好，世界！这是一个测试。"+
+		"func main() { fmt.Println(\"hello\") }\n",
+	4096,
+))
+
+func BenchmarkEncode(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tkn.Encode(benchmarkText); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkASCIIText is an English sample repeated to roughly 1 MiB.
+var benchmarkASCIIText = []byte(strings.Repeat(
+	"The quick brown fox jumps over the lazy dog. "+
+		"It was the best of times, it was the worst of times; it was the age of wisdom.\n"+
+		"In 2024, roughly 1,234 developers reported issues with tokenization (see #42).\n",
+	5120,
+))
+
+func benchmarkEncodeASCII(b *testing.B, prepared bool) {
+	tkn := newWorldTokenizer(b)
+	if prepared {
+		tkn.PrepareEncode()
+	}
+
+	b.SetBytes(int64(len(benchmarkASCIIText)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tkn.Encode(benchmarkASCIIText); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeASCII(b *testing.B)         { benchmarkEncodeASCII(b, false) }
+func BenchmarkEncodeASCIIPrepared(b *testing.B) { benchmarkEncodeASCII(b, true) }
+
+// TestPrepareEncode tests that the ASCII fast path gives the same results as
+// the trie, and that it is discarded when the vocabulary changes.
+func TestPrepareEncode(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	texts := []string{
+		"",
+		string(benchmarkASCIIText[:4096]),
+		"\x00\x7f\t\r\n   ",
+		"Hello, world! こんにちは",
+	}
+
+	want := make([][]int, len(texts))
+	for i, text := range texts {
+		want[i], _ = tkn.EncodeString(text)
+	}
+
+	tkn.PrepareEncode()
+	if tkn.asciiTrie == nil {
+		t.Fatalf(`PrepareEncode() did not build the ASCII trie`)
+	}
+	for i, text := range texts {
+		if tokens, err := tkn.EncodeString(text); !intSliceEquals(tokens, want[i]) || err != nil {
+			t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, tokens, err, want[i])
+		}
+	}
+
+	tkn.AddTokenString("Hello, world!", 70000)
+	if tkn.asciiTrie != nil {
+		t.Fatalf(`AddTokenString() did not discard the ASCII trie`)
+	}
+	if tokens, err := tkn.EncodeString("Hello, world!"); !intSliceEquals(tokens, []int{70000}) || err != nil {
+		t.Fatalf(`EncodeString("Hello, world!") = %v, %v, want equal to [70000]`, tokens, err)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+	tokens, err := tkn.Encode(benchmarkText)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tkn.Decode(tokens); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePrepared(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+	tokens, err := tkn.Encode(benchmarkText)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tkn.PrepareDecode()
+
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tkn.Decode(tokens); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+	tokens, err := tkn.Encode(benchmarkText)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 0, len(benchmarkText))
+
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buf, err = tkn.DecodeInto(buf[:0], tokens); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRoundtrip(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tokens, err := tkn.Encode(benchmarkText)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tkn.Decode(tokens); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestSetEncodeUnknownID tests that unmatched bytes are replaced with the
+// configured token ID.
+func TestSetEncodeUnknownID(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("bc", 2)
+
+	s := "axbcyy"
+	if _, err := tkn.EncodeString(s); err != ErrCannotTokenize {
+		t.Fatalf(`EncodeString(%q) = _, %v, want %v`, s, err, ErrCannotTokenize)
+	}
+
+	tkn.SetEncodeUnknownID(0)
+	i := []int{1, 0, 2, 0, 0}
+	x, err := tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+}
+
+// TestIsTotal tests IsTotal with the default vocabulary and an incomplete one.
+func TestIsTotal(t *testing.T) {
+	if !newWorldTokenizer(t).IsTotal() {
+		t.Fatalf(`IsTotal() = false for the default vocabulary, want true`)
+	}
+
+	tkn := NewTokenizer()
+	tkn.AddTokenString("ab", 1)
+	if tkn.IsTotal() {
+		t.Fatalf(`IsTotal() = true for an incomplete vocabulary, want false`)
+	}
+}
+
+// TestNewTokenizerFromFS tests loading a vocabulary from an fs.FS.
+func TestNewTokenizerFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"vocab.txt": {Data: []byte("1 'a' 1\n2 'b' 1\n3 'ab' 2\n")},
+	}
+
+	tkn, err := NewTokenizerFromFS(fsys, "vocab.txt")
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromFS() = %v`, err)
+	}
+
+	s, i := "aba", []int{3, 1}
+	x, err := tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+
+	if _, err := NewTokenizerFromFS(fsys, "missing.txt"); err == nil {
+		t.Fatalf(`NewTokenizerFromFS("missing.txt") = nil, want error`)
+	}
+}
+
+func BenchmarkNewWorldTokenizer(b *testing.B) {
+	var tkn *Tokenizer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tkn = newWorldTokenizer(b)
+	}
+	b.ReportMetric(float64(tkn.ApproxMemoryBytes()), "vocab-bytes")
+}
+
+// TestDecodeInto tests appending decoded tokens to an existing buffer.
+func TestDecodeInto(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	i, s := []int{33155, 45}, ">Hello,"
+	x, err := tkn.DecodeInto([]byte(">"), i)
+	if string(x) != s || err != nil {
+		t.Fatalf(`DecodeInto(">", %v) = %q, %v, want equal to %q`, i, x, err, s)
+	}
+
+	if _, err := tkn.DecodeInto(nil, []int{-1}); err != ErrUnknownToken {
+		t.Fatalf(`DecodeInto(nil, [-1]) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// TestTryAddToken tests that TryAddToken refuses to overwrite existing
+// vocabulary entries.
+func TestTryAddToken(t *testing.T) {
+	tkn := NewTokenizer()
+	if err := tkn.TryAddToken("a", 1); err != nil {
+		t.Fatalf(`TryAddToken("a", 1) = %v, want nil`, err)
+	}
+	if err := tkn.TryAddToken("a", 1); err != nil {
+		t.Fatalf(`TryAddToken("a", 1) = %v, want nil`, err)
+	}
+	if err := tkn.TryAddToken("b", 1); !errors.Is(err, ErrTokenConflict) {
+		t.Fatalf(`TryAddToken("b", 1) = %v, want %v`, err, ErrTokenConflict)
+	}
+	if err := tkn.TryAddToken("a", 2); !errors.Is(err, ErrTokenConflict) {
+		t.Fatalf(`TryAddToken("a", 2) = %v, want %v`, err, ErrTokenConflict)
+	}
+
+	if token, err := tkn.IDToToken(1); token != "a" || err != nil {
+		t.Fatalf(`IDToToken(1) = %q, %v, want equal to "a"`, token, err)
+	}
+}
+
+// TestSetAddPrefixSpace tests that the injected prefix space affects
+// encoding and is removed again when decoding.
+func TestSetAddPrefixSpace(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	i, err := tkn.EncodeString(" hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tkn.SetAddPrefixSpace(true)
+	s := "hello"
+	x, err := tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+
+	y, err := tkn.DecodeToString(x)
+	if y != s || err != nil {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q`, x, y, err, s)
+	}
+
+	z, err := tkn.DecodeInto([]byte(">"), x)
+	if string(z) != ">"+s || err != nil {
+		t.Fatalf(`DecodeInto(">", %v) = %q, %v, want equal to %q`, x, z, err, ">"+s)
+	}
+}
+
+// TestExplainEncode tests that the trace lists every candidate match and
+// marks the chosen one.
+func TestExplainEncode(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("ab", 2)
+	tkn.AddTokenString("abc", 3)
+	tkn.AddTokenString("d", 4)
+
+	s := "abcdx"
+	x := tkn.ExplainEncode(s)
+	y := "0: \"a\"(1) \"ab\"(2) *\"abc\"(3)\n3: *\"d\"(4)\n4: no match for byte 0x78\n"
+	if x != y {
+		t.Fatalf(`ExplainEncode(%q) = %q, want equal to %q`, s, x, y)
+	}
+}
+
+// TestNewTokenizerFromFileGzip tests loading a gzip-compressed vocabulary.
+func TestNewTokenizerFromFileGzip(t *testing.T) {
+	vocab := []byte("1 'a' 1\n2 'b' 1\n3 'ab' 2\n")
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(vocab)
+	zw.Close()
+
+	path := filepath.Join(t.TempDir(), "vocab.txt.gz")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tkn, err := NewTokenizerFromFile(path)
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromFile(%q) = %v`, path, err)
+	}
+	ref, err := NewTokenizerFromReader(bytes.NewReader(vocab))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := "abba"
+	i, _ := ref.EncodeString(s)
+	x, err := tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+}
+
+// TestTokenKind tests classification of byte, text and special tokens.
+func TestTokenKind(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.AddSpecialToken("<|endoftext|>", 70000)
+
+	for id, k := range map[int]Kind{256: KindByte, 2416: KindByte, 33155: KindText, 70000: KindSpecial} {
+		x, err := tkn.TokenKind(id)
+		if x != k || err != nil {
+			t.Fatalf(`TokenKind(%d) = %v, %v, want equal to %v`, id, x, err, k)
+		}
+	}
+
+	if _, err := tkn.TokenKind(-1); err != ErrUnknownToken {
+		t.Fatalf(`TokenKind(-1) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// TestHealAndEncode tests that healing merges the last prefix token with
+// the continuation.
+func TestHealAndEncode(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	prefix, err := tkn.EncodeString("Hello, wor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := tkn.EncodeString("Hello, world!")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := tkn.HealAndEncode(prefix, []byte("ld!"))
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`HealAndEncode(%v, "ld!") = %v, %v, want equal to %v`, prefix, x, err, i)
+	}
+
+	// The continuation is prepared like input to Encode.
+	tkn.SetAddPrefixSpace(true)
+	tkn.SetNormalizeNewlines(true)
+	i, _ = tkn.EncodeString("hello")
+	if x, err := tkn.HealAndEncode(nil, []byte("hello")); !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`HealAndEncode(nil, "hello") = %v, %v, want equal to %v`, x, err, i)
+	}
+	prefix, _ = tkn.EncodeString("Hello")
+	i, _ = tkn.EncodeString("Hello,\n\nworld")
+	if x, err := tkn.HealAndEncode(prefix, []byte(",\r\n\r\nworld")); !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`HealAndEncode(%v, ",\r\n\r\nworld") = %v, %v, want equal to %v`, prefix, x, err, i)
+	}
+}
+
+// TestDecodeWithOffsets tests that the offsets locate each token's text.
+func TestDecodeWithOffsets(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world! こんにちは、世界！"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, o, err := tkn.DecodeWithOffsets(i)
+	if x != s || len(o) != len(i) || err != nil {
+		t.Fatalf(`DecodeWithOffsets(%v) = %q, %v, %v, want equal to %q`, i, x, o, err, s)
+	}
+	for j, v := range i {
+		token, _ := tkn.IDToToken(v)
+		if y := x[o[j][0]:o[j][1]]; y != token {
+			t.Fatalf(`DecodeWithOffsets(%v) offset %d = %q, want equal to %q`, i, j, y, token)
+		}
+	}
+}
+
+// TestEncodeAvoiding tests that forbidden tokens are replaced by an
+// alternative segmentation.
+func TestEncodeAvoiding(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("b", 2)
+	tkn.AddTokenString("c", 3)
+	tkn.AddTokenString("ab", 4)
+	tkn.AddTokenString("abc", 5)
+	tkn.AddTokenString("bc", 6)
+
+	s := "abc"
+	for _, tc := range []struct {
+		forbidden map[int]bool
+		tokens    []int
+	}{
+		{nil, []int{5}},
+		{map[int]bool{5: true}, []int{4, 3}},
+		{map[int]bool{4: true, 5: true}, []int{1, 6}},
+		{map[int]bool{4: true, 5: true, 6: true}, []int{1, 2, 3}},
+	} {
+		x, err := tkn.EncodeAvoiding([]byte(s), tc.forbidden)
+		if !intSliceEquals(x, tc.tokens) || err != nil {
+			t.Fatalf(`EncodeAvoiding(%q, %v) = %v, %v, want equal to %v`, s, tc.forbidden, x, err, tc.tokens)
+		}
+	}
+
+	forbidden := map[int]bool{1: true, 4: true, 5: true}
+	if _, err := tkn.EncodeAvoiding([]byte(s), forbidden); err != ErrCannotTokenize {
+		t.Fatalf(`EncodeAvoiding(%q, %v) = _, %v, want %v`, s, forbidden, err, ErrCannotTokenize)
+	}
+
+	// Rejected input is not encoded by the fallback search either.
+	forbidden = map[int]bool{5: true}
+	tkn.SetMaxInputBytes(2)
+	if x, err := tkn.EncodeAvoiding([]byte(s), forbidden); err != ErrInputTooLarge {
+		t.Fatalf(`EncodeAvoiding(%q, %v) = %v, %v, want %v`, s, forbidden, x, err, ErrInputTooLarge)
+	}
+	tkn.SetMaxInputBytes(0)
+
+	tkn.AddTokenString("\uFFFD", 7)
+	tkn.SetRejectReplacementChar(true)
+	s = "a\uFFFD"
+	if x, err := tkn.EncodeAvoiding([]byte(s), forbidden); err != ErrReplacementChar {
+		t.Fatalf(`EncodeAvoiding(%q, %v) = %v, %v, want %v`, s, forbidden, x, err, ErrReplacementChar)
+	}
+}
+
+// TestWorldVocabBytes tests that the exported vocabulary data can be
+// parsed and is a copy.
+func TestWorldVocabBytes(t *testing.T) {
+	if rwkvVocab20230424 == nil {
+		t.Skip("built without the embedded World vocabulary")
+	}
+
+	b := WorldVocabBytes()
+	tkn, err := NewTokenizerFromReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReader(WorldVocabBytes()) = %v`, err)
+	}
+	if err := tkn.SelfTest(); err != nil {
+		t.Fatalf(`SelfTest() = %v, want nil`, err)
+	}
+
+	b[0] = '#'
+	if c := WorldVocabBytes(); c[0] == '#' {
+		t.Fatalf(`WorldVocabBytes() returned shared data`)
+	}
+}
+
+// TestLongestMatch pins the greedy longest-match semantics of Encode for
+// overlapping tokens.
+func TestLongestMatch(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("b", 2)
+	tkn.AddTokenString("c", 3)
+	tkn.AddTokenString("d", 4)
+	tkn.AddTokenString("ab", 5)
+	tkn.AddTokenString("abc", 6)
+	tkn.AddTokenString("bcd", 7)
+
+	for s, i := range map[string][]int{
+		"abc":  {6},
+		"ab":   {5},
+		"abd":  {5, 4},
+		"abcd": {6, 4},
+		"bcd":  {7},
+		"abab": {5, 5},
+	} {
+		x, err := tkn.EncodeString(s)
+		if !intSliceEquals(x, i) || err != nil {
+			t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+		}
+	}
+}
+
+// TestEncodeInt32 tests encoding to int32 token IDs.
+func TestEncodeInt32(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world!"
+	i := []int32{33155, 45, 40213, 34}
+	x, err := tkn.EncodeInt32([]byte(s))
+	if len(x) != len(i) || err != nil {
+		t.Fatalf(`EncodeInt32(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+	for j := range x {
+		if x[j] != i[j] {
+			t.Fatalf(`EncodeInt32(%q) = %v, want equal to %v`, s, x, i)
+		}
+	}
+
+	if big := int64(math.MaxInt32) + 1; int64(int(big)) == big {
+		tkn.AddTokenString("\U0001F600", int(big))
+		if _, err := tkn.EncodeInt32([]byte("\U0001F600")); err != ErrIDOutOfRange {
+			t.Fatalf(`EncodeInt32(%q) = _, %v, want %v`, "\U0001F600", err, ErrIDOutOfRange)
+		}
+	}
+}
+
+// TestEncodeInt32Into tests appending int32 token IDs to a reused buffer.
+func TestEncodeInt32Into(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	s := "Hello, world!"
+	i := []int32{7, 33155, 45, 40213, 34}
+	x, err := tkn.EncodeInt32Into([]int32{7}, []byte(s))
+	if len(x) != len(i) || err != nil {
+		t.Fatalf(`EncodeInt32Into([7], %q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+	for j := range x {
+		if x[j] != i[j] {
+			t.Fatalf(`EncodeInt32Into([7], %q) = %v, want equal to %v`, s, x, i)
+		}
+	}
+
+	if big := int64(math.MaxInt32) + 1; int64(int(big)) == big {
+		tkn.AddTokenString("\U0001F600", int(big))
+		s = "Hi\U0001F600"
+		if x, err := tkn.EncodeInt32Into(x[:0], []byte(s)); len(x) != 1 || err != ErrIDOutOfRange {
+			t.Fatalf(`EncodeInt32Into(_, %q) = %v, %v, want one token, %v`, s, x, err, ErrIDOutOfRange)
+		}
+	}
+}
+
+func BenchmarkEncodeInt32Into(b *testing.B) {
+	tkn := newWorldTokenizer(b)
+	var buf []int32
+
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = tkn.EncodeInt32Into(buf[:0], benchmarkText); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestSetDecodeFilter tests that the decode filter is applied and can be
+// removed.
+func TestSetDecodeFilter(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	i := []int{33155, 45, 40213, 34}
+	tkn.SetDecodeFilter(strings.ToUpper)
+	s := "HELLO, WORLD!"
+	x, err := tkn.DecodeToString(i)
+	if x != s || err != nil {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q`, i, x, err, s)
+	}
+	y, err := tkn.DecodeInto([]byte("> "), i)
+	if string(y) != "> "+s || err != nil {
+		t.Fatalf(`DecodeInto("> ", %v) = %q, %v, want equal to %q`, i, y, err, "> "+s)
+	}
+
+	tkn.SetDecodeFilter(nil)
+	s = "Hello, world!"
+	z, err := tkn.Decode(i)
+	if string(z) != s || err != nil {
+		t.Fatalf(`Decode(%v) = %q, %v, want equal to %q`, i, z, err, s)
+	}
+}
+
+// TestSetRuneFallback tests that unmatched characters are replaced as a
+// whole, and that invalid bytes are still replaced one at a time.
+func TestSetRuneFallback(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("b", 2)
+	tkn.AddToken([]byte{0xb8}, 3)
+	tkn.AddToken([]byte{0x96}, 4)
+	tkn.AddToken([]byte{0xb8, 0x96, 'b'}, 5)
+	tkn.SetEncodeUnknownID(0)
+
+	s := "a世b\xffa"
+	i := []int{1, 0, 5, 0, 1}
+	x, err := tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+
+	tkn.SetRuneFallback(true)
+	i = []int{1, 0, 3, 4, 2, 0, 1}
+	x, err = tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+}
+
+// TestPrepareDecode tests that decoding gives the same results with the
+// lookup table, including after the vocabulary changes.
+func TestPrepareDecode(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.PrepareDecode()
+
+	s := "Hello, world! こんにちは、世界！"
+	i, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := tkn.DecodeToString(i)
+	if x != s || err != nil {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q`, i, x, err, s)
+	}
+
+	tkn.AddTokenString("Howdy", 33155)
+	i, s = []int{33155, -1}, "Howdy"
+	x, err = tkn.DecodeToString(i)
+	if x != s || err != ErrUnknownToken {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q, %v`, i, x, err, s, ErrUnknownToken)
+	}
+}
+
+// TestNewTokenizerFromHexReader tests loading a hexadecimal vocabulary and
+// rejecting malformed hex bytes.
+func TestNewTokenizerFromHexReader(t *testing.T) {
+	vocab := "# hex vocabulary\n1 61\n2 62\n3 e4 b8 96\n4 61 62\n5 ff"
+	tkn, err := NewTokenizerFromHexReader(strings.NewReader(vocab))
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromHexReader() = %v`, err)
+	}
+
+	s, i := "aba世\xff", []int{4, 1, 3, 5}
+	x, err := tkn.EncodeString(s)
+	if !intSliceEquals(x, i) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, x, err, i)
+	}
+	y, err := tkn.DecodeToString(x)
+	if y != s || err != nil {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q`, x, y, err, s)
+	}
+
+	for _, vocab := range []string{"1 6", "1 616", "1 zz", "x 61", "1"} {
+		if _, err := NewTokenizerFromHexReader(strings.NewReader(vocab)); !errors.Is(err, ErrMalformedVocabulary) {
+			t.Fatalf(`NewTokenizerFromHexReader(%q) = %v, want %v`, vocab, err, ErrMalformedVocabulary)
+		}
+	}
+}
+
+// TestIsCompleteUTF8 tests a text token, a partial character byte token
+// and an unknown ID.
+func TestIsCompleteUTF8(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	for id, v := range map[int]bool{33155: true, 10115: true, 0xe4 + 1: false, 2416: false, -1: false} {
+		if x := tkn.IsCompleteUTF8(id); x != v {
+			t.Fatalf(`IsCompleteUTF8(%d) = %v, want %v`, id, x, v)
+		}
+	}
+}
+
+// TestSetMaxMatchLen tests that tokens longer than the limit are not
+// matched.
+func TestSetMaxMatchLen(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.AddTokenString("b", 2)
+	tkn.AddTokenString("c", 3)
+	tkn.AddTokenString("ab", 4)
+	tkn.AddTokenString("abc", 5)
+
+	s := "abcabc"
+	for n, i := range map[int][]int{0: {5, 5}, 3: {5, 5}, 2: {4, 3, 4, 3}, 1: {1, 2, 3, 1, 2, 3}} {
+		tkn.SetMaxMatchLen(n)
+		x, err := tkn.EncodeString(s)
+		if !intSliceEquals(x, i) || err != nil {
+			t.Fatalf(`EncodeString(%q) with SetMaxMatchLen(%d) = %v, %v, want equal to %v`, s, n, x, err, i)
+		}
+	}
+}
+
+// TestDecodeToWriter tests decoding to an io.Writer in strict and
+// non-strict mode, and decoding a large sequence.
+func TestDecodeToWriter(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	i := []int{33155, -1, 45}
+	for strict, s := range map[bool]string{true: "Hello", false: "Hello,"} {
+		var b bytes.Buffer
+		n, err := tkn.DecodeToWriter(&b, i, strict)
+		if b.String() != s || n != len(s) || err != ErrUnknownToken {
+			t.Fatalf(`DecodeToWriter(%v, %v) = %q, %d, %v, want equal to %q, %d, %v`, i, strict, b.String(), n, err, s, len(s), ErrUnknownToken)
+		}
+	}
+
+	i, err := tkn.Encode(benchmarkText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	n, err := tkn.DecodeToWriter(&b, i, true)
+	if !bytes.Equal(b.Bytes(), benchmarkText) || n != len(benchmarkText) || err != nil {
+		t.Fatalf(`DecodeToWriter(benchmarkText tokens) = %d bytes, %v, want equal to benchmarkText`, n, err)
+	}
+}
+
+// TestVocabHashCharTokens tests that tokens containing '#' are loaded rather than
+// treated as comments.
+func TestVocabHashCharTokens(t *testing.T) {
+	tkn, err := NewTokenizerFromFile("testdata/hash_vocab.txt")
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromFile() = %v`, err)
+	}
+
+	for id, token := range map[int]string{1: "#", 2: "##", 3: "# ", 4: " #", 5: "a#b"} {
+		x, err := tkn.IDToToken(id)
+		if x != token || err != nil {
+			t.Fatalf(`IDToToken(%d) = %q, %v, want equal to %q`, id, x, err, token)
+		}
+	}
+	if len(tkn.i2t) != 5 {
+		t.Fatalf(`vocabulary has %d tokens, want 5`, len(tkn.i2t))
+	}
+}
+
+// TestRecombine tests that byte tokens spelling out a longer token are
+// replaced by it.
+func TestRecombine(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	var i []int
+	for _, c := range []byte("Hello, 世界") {
+		i = append(i, int(c)+1)
+	}
+	y, err := tkn.EncodeString("Hello, 世界")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := tkn.Recombine(i)
+	if !intSliceEquals(x, y) || err != nil {
+		t.Fatalf(`Recombine(%v) = %v, %v, want equal to %v`, i, x, err, y)
+	}
+
+	if _, err := tkn.Recombine([]int{-1}); err != ErrUnknownToken {
+		t.Fatalf(`Recombine([-1]) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// TestUnicodeEscapes tests parsing tokens with \x, \u and \U escapes, and an
+// escaped backslash followed by an x.
+func TestUnicodeEscapes(t *testing.T) {
+	vocab := `1 '\xe9' 2
+2 '世' 3
+3 '\U0001f600' 4
+4 '\\x41' 4
+5 b'\xe9' 1
+6 '\xe9世' 5
+7 "\\\xe9" 3
+`
+	tkn, err := NewTokenizerFromReader(strings.NewReader(vocab))
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReader() = %v`, err)
+	}
+
+	for id, token := range map[int]string{1: "é", 2: "世", 3: "😀", 4: `\x41`, 5: "\xe9", 6: "é世", 7: `\é`} {
+		x, err := tkn.IDToToken(id)
+		if x != token || err != nil {
+			t.Fatalf(`IDToToken(%d) = %q, %v, want equal to %q`, id, x, err, token)
+		}
+	}
+}
+
+// TestDocumentSeparator tests that no token spans a document separator and
+// that the separator token appears between documents.
+func TestDocumentSeparator(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	docs := []string{"Hello, world!", "\n\nHello", "", "world!\n\n"}
+
+	var want []int
+	for i, doc := range docs {
+		if i > 0 {
+			want = append(want, 0)
+		}
+		tokens, err := tkn.EncodeString(doc)
+		if err != nil {
+			t.Fatalf(`EncodeString(%q) = %v`, doc, err)
+		}
+		want = append(want, tokens...)
+	}
+
+	tkn.SetDocumentSeparator(0, 0)
+	defer tkn.SetDocumentSeparator(0, -1)
+	text := strings.Join(docs, "\x00")
+	tokens, err := tkn.EncodeString(text)
+	if !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, tokens, err, want)
+	}
+}
+
+// TestDocumentSeparatorVariants tests that the other encode methods split
+// documents the same way as Encode.
+func TestDocumentSeparatorVariants(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.SetDocumentSeparator(0, 0)
+	defer tkn.SetDocumentSeparator(0, -1)
+
+	text := "ab\x00ab"
+	want := []int{1734, 0, 1734}
+	if x, err := tkn.EncodeString(text); !intSliceEquals(x, want) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, x, err, want)
+	}
+
+	x32, err := tkn.EncodeInt32([]byte(text))
+	x := make([]int, len(x32))
+	for i, v := range x32 {
+		x[i] = int(v)
+	}
+	if !intSliceEquals(x, want) || err != nil {
+		t.Fatalf(`EncodeInt32(%q) = %v, %v, want equal to %v`, text, x32, err, want)
+	}
+
+	var buf TokenBuffer
+	if err := tkn.EncodeStringBuffered(text, &buf); !intSliceEquals(buf.IDs, want) || err != nil {
+		t.Fatalf(`EncodeStringBuffered(%q) = %v, %v, want equal to %v`, text, buf.IDs, err, want)
+	}
+
+	x, lastMayExtend, err := tkn.EncodePrefix([]byte(text))
+	if !intSliceEquals(x, want) || !lastMayExtend || err != nil {
+		t.Fatalf(`EncodePrefix(%q) = %v, %v, %v, want equal to %v, true`, text, x, lastMayExtend, err, want)
+	}
+	text2 := "ab\x00"
+	x, lastMayExtend, err = tkn.EncodePrefix([]byte(text2))
+	if !intSliceEquals(x, want[:2]) || lastMayExtend || err != nil {
+		t.Fatalf(`EncodePrefix(%q) = %v, %v, %v, want equal to %v, false`, text2, x, lastMayExtend, err, want[:2])
+	}
+
+	forbidden := map[int]bool{1734: true}
+	doc, err := tkn.EncodeAvoiding([]byte("ab"), forbidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(append(append([]int{}, doc...), 0), doc...)
+	if x, err := tkn.EncodeAvoiding([]byte(text), forbidden); !intSliceEquals(x, want) || err != nil {
+		t.Fatalf(`EncodeAvoiding(%q) = %v, %v, want equal to %v`, text, x, err, want)
+	}
+	forbidden[0] = true
+	if x, err := tkn.EncodeAvoiding([]byte(text), forbidden); err != ErrCannotTokenize {
+		t.Fatalf(`EncodeAvoiding(%q) with the separator forbidden = %v, %v, want equal to ErrCannotTokenize`, text, x, err)
+	}
+}
+
+// TestIDRange tests IDRange against the World vocabulary and an empty one.
+func TestIDRange(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	if min, max := tkn.IDRange(); min != 1 || max != 65529 {
+		t.Fatalf(`IDRange() = %d, %d, want equal to 1, 65529`, min, max)
+	}
+
+	if min, max := NewTokenizer().IDRange(); min != 0 || max != -1 {
+		t.Fatalf(`NewTokenizer().IDRange() = %d, %d, want equal to 0, -1`, min, max)
+	}
+}
+
+// TestLenientLengths tests that a length given in runes is only accepted by
+// the lenient loader.
+func TestLenientLengths(t *testing.T) {
+	vocab := "1 'a' 1\n2 '世界' 2\n3 b'\\xe4' 1\n"
+
+	if _, err := NewTokenizerFromReader(strings.NewReader(vocab)); err != ErrMalformedVocabulary {
+		t.Fatalf(`NewTokenizerFromReader() = _, %v, want equal to ErrMalformedVocabulary`, err)
+	}
+
+	tkn, err := NewTokenizerFromReaderLenient(strings.NewReader(vocab))
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReaderLenient() = _, %v`, err)
+	}
+	if token, err := tkn.IDToToken(2); token != "世界" || err != nil {
+		t.Fatalf(`IDToToken(2) = %q, %v, want equal to "世界"`, token, err)
+	}
+
+	if _, err := NewTokenizerFromReaderLenient(strings.NewReader("1 '世界' 3\n")); err != ErrMalformedVocabulary {
+		t.Fatalf(`NewTokenizerFromReaderLenient() = _, %v, want equal to ErrMalformedVocabulary`, err)
+	}
+}
+
+// TestDecodeRange tests DecodeRange against DecodeToString and checks its
+// bounds.
+func TestDecodeRange(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tokens, _ := tkn.EncodeString("Hello, world! こんにちは")
+
+	for i := 0; i <= len(tokens); i++ {
+		for j := i; j <= len(tokens); j++ {
+			want, _ := tkn.DecodeToString(tokens[i:j])
+			if text, err := tkn.DecodeRange(tokens, i, j); text != want || err != nil {
+				t.Fatalf(`DecodeRange(%v, %d, %d) = %q, %v, want equal to %q`, tokens, i, j, text, err, want)
+			}
+		}
+	}
+
+	for _, r := range [][2]int{{-1, 1}, {2, 1}, {0, len(tokens) + 1}} {
+		if _, err := tkn.DecodeRange(tokens, r[0], r[1]); err != ErrInvalidRange {
+			t.Fatalf(`DecodeRange(%v, %d, %d) = _, %v, want equal to ErrInvalidRange`, tokens, r[0], r[1], err)
+		}
+	}
+}
+
+// TestValidateIDs tests finding the first unknown ID in a token stream.
+func TestValidateIDs(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	i := []int{33155, 45, 65530, 1, -1}
+	if index, ok := tkn.ValidateIDs(i); index != 2 || ok {
+		t.Fatalf(`ValidateIDs(%v) = %d, %v, want equal to 2, false`, i, index, ok)
+	}
+
+	i = i[:2]
+	if index, ok := tkn.ValidateIDs(i); index != -1 || !ok {
+		t.Fatalf(`ValidateIDs(%v) = %d, %v, want equal to -1, true`, i, index, ok)
+	}
+}
+
+// TestEncodeFunc tests that EncodeFunc emits the same tokens as Encode and
+// stops as soon as the callback returns an error.
+func TestEncodeFunc(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	text := []byte("Hello, world! こんにちは")
+	want, _ := tkn.Encode(text)
+
+	var tokens []int
+	err := tkn.EncodeFunc(text, func(id int) error {
+		tokens = append(tokens, id)
+		return nil
+	})
+	if !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`EncodeFunc(%q) emitted %v, %v, want equal to %v`, text, tokens, err, want)
+	}
+
+	errFull := errors.New("buffer full")
+	tokens = tokens[:0]
+	err = tkn.EncodeFunc(text, func(id int) error {
+		if len(tokens) == 3 {
+			return errFull
+		}
+		tokens = append(tokens, id)
+		return nil
+	})
+	if !intSliceEquals(tokens, want[:3]) || err != errFull {
+		t.Fatalf(`EncodeFunc(%q) emitted %v, %v, want equal to %v, %v`, text, tokens, err, want[:3], errFull)
+	}
+
+	// Documents are split as by Encode.
+	tkn.SetDocumentSeparator(0, 0)
+	defer tkn.SetDocumentSeparator(0, -1)
+	text = []byte("ab\x00ab")
+	want = []int{1734, 0, 1734}
+	tokens = tokens[:0]
+	err = tkn.EncodeFunc(text, func(id int) error {
+		tokens = append(tokens, id)
+		return nil
+	})
+	if !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`EncodeFunc(%q) emitted %v, %v, want equal to %v`, text, tokens, err, want)
+	}
+	if freq, err := tkn.TokenFrequencies(text); freq[1734] != 2 || freq[0] != 1 || err != nil {
+		t.Fatalf(`TokenFrequencies(%q) = %v, %v, want 2 of 1734 and 1 of 0`, text, freq, err)
+	}
+}
+
+// TestReserveIDs tests that reserved IDs decode to the placeholder, are
+// never produced by encoding, and give way to a token assigned later.
+func TestReserveIDs(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.ReserveIDs(0, 65530)
+	tkn.SetReservedPlaceholder("<reserved>")
+
+	i, s := []int{0, 33155, 65530, 65531}, "<reserved>Hello<reserved>"
+	x, err := tkn.DecodeToString(i)
+	if x != s || err != ErrUnknownToken {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q, %v`, i, x, err, s, ErrUnknownToken)
+	}
+
+	if k, err := tkn.TokenKind(0); k != KindReserved || err != nil {
+		t.Fatalf(`TokenKind(0) = %v, %v, want equal to %v`, k, err, KindReserved)
+	}
+	if _, err := tkn.IDToToken(0); err != ErrUnknownToken {
+		t.Fatalf(`IDToToken(0) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+
+	tokens, err := tkn.EncodeString(s)
+	for _, v := range tokens {
+		if v == 0 || v == 65530 || err != nil {
+			t.Fatalf(`EncodeString(%q) = %v, %v, want no reserved IDs`, s, tokens, err)
+		}
+	}
+
+	tkn.AddSpecialToken("<|endoftext|>", 0)
+	if x, err := tkn.DecodeToString([]int{0}); x != "<|endoftext|>" || err != nil {
+		t.Fatalf(`DecodeToString([0]) = %q, %v, want equal to "<|endoftext|>"`, x, err)
+	}
+}
+
+// TestNormalizeNewlines tests that CRLF, CR and LF line endings encode the
+// same when newline normalization is enabled.
+func TestNormalizeNewlines(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	lf := "Hello,\nworld!\n\nBye.\n"
+
+	want, _ := tkn.EncodeString(lf)
+	for _, text := range []string{"Hello,\r\nworld!\r\n\r\nBye.\r\n", "Hello,\rworld!\r\rBye.\r", "Hello,\r\nworld!\n\rBye.\n"} {
+		if tokens, _ := tkn.EncodeString(text); intSliceEquals(tokens, want) {
+			t.Fatalf(`EncodeString(%q) = %v, want different from %v`, text, tokens, want)
+		}
+
+		tkn.SetNormalizeNewlines(true)
+		tokens, err := tkn.EncodeString(text)
+		tkn.SetNormalizeNewlines(false)
+		if !intSliceEquals(tokens, want) || err != nil {
+			t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, tokens, err, want)
+		}
+	}
+
+	tkn.SetNormalizeNewlines(true)
+	defer tkn.SetNormalizeNewlines(false)
+	full, _ := tkn.EncodeString("Hello,\nworld!")
+	prefix, _ := tkn.EncodeString("Hello,\n")
+	if delta, err := tkn.AppendTokenDelta("Hello,\r", "\nworld!"); delta != len(full)-len(prefix) || err != nil {
+		t.Fatalf(`AppendTokenDelta("Hello,\r", "\nworld!") = %d, %v, want equal to %d`, delta, err, len(full)-len(prefix))
+	}
+}
+
+// TestDefaultWorldTokenizer tests that concurrent calls share one Tokenizer.
+func TestDefaultWorldTokenizer(t *testing.T) {
+	if rwkvVocab20230424 == nil {
+		t.Skip("built without the embedded World vocabulary")
+	}
+
+	var wg sync.WaitGroup
+	tkns := make([]*Tokenizer, 8)
+	for i := range tkns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tkns[i] = DefaultWorldTokenizer()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, tkn := range tkns {
+		if tkn == nil || tkn != DefaultWorldTokenizer() {
+			t.Fatalf(`DefaultWorldTokenizer() = %p on call %d, want equal to %p`, tkn, i, DefaultWorldTokenizer())
+		}
+	}
+
+	if tokens, err := DefaultWorldTokenizer().EncodeString("Hello"); !intSliceEquals(tokens, []int{33155}) || err != nil {
+		t.Fatalf(`DefaultWorldTokenizer().EncodeString("Hello") = %v, %v, want equal to [33155]`, tokens, err)
+	}
+}
+
+// TestHasDuplicateTokens tests finding IDs that share a token.
+func TestHasDuplicateTokens(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	if dup, groups := tkn.HasDuplicateTokens(); dup || len(groups) != 0 {
+		t.Fatalf(`HasDuplicateTokens() = %v, %v, want equal to false, []`, dup, groups)
+	}
+
+	tkn.AddTokenString("Hello", 70001)
+	tkn.AddTokenString("Hello", 70000)
+	tkn.AddTokenString("a", 65600)
+	dup, groups := tkn.HasDuplicateTokens()
+	if !dup || len(groups) != 2 || !intSliceEquals(groups[0], []int{98, 65600}) || !intSliceEquals(groups[1], []int{33155, 70000, 70001}) {
+		t.Fatalf(`HasDuplicateTokens() = %v, %v, want equal to true, [[98 65600] [33155 70000 70001]]`, dup, groups)
+	}
+}
+
+// TestHasDuplicateTokensReassigned tests that a duplicate goes away once one
+// of the IDs sharing the token is reassigned.
+func TestHasDuplicateTokensReassigned(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 0)
+	tkn.AddTokenString("a", 1)
+	if dup, groups := tkn.HasDuplicateTokens(); !dup || len(groups) != 1 || !intSliceEquals(groups[0], []int{0, 1}) {
+		t.Fatalf(`HasDuplicateTokens() = %v, %v, want equal to true, [[0 1]]`, dup, groups)
+	}
+
+	tkn.AddTokenString("c", 1)
+	if dup, groups := tkn.HasDuplicateTokens(); dup || len(groups) != 0 {
+		t.Fatalf(`HasDuplicateTokens() = %v, %v, want equal to false, []`, dup, groups)
+	}
+}
+
+// TestMaxInputBytes tests that input over the limit is rejected and input up
+// to it is encoded.
+func TestMaxInputBytes(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	tkn.SetMaxInputBytes(5)
+
+	if tokens, err := tkn.EncodeString("Hello"); !intSliceEquals(tokens, []int{33155}) || err != nil {
+		t.Fatalf(`EncodeString("Hello") = %v, %v, want equal to [33155]`, tokens, err)
+	}
+	if tokens, err := tkn.EncodeString("Hello!"); tokens != nil || err != ErrInputTooLarge {
+		t.Fatalf(`EncodeString("Hello!") = %v, %v, want equal to nil, %v`, tokens, err, ErrInputTooLarge)
+	}
+	if err := tkn.EncodeFunc([]byte("Hello!"), func(int) error { return nil }); err != ErrInputTooLarge {
+		t.Fatalf(`EncodeFunc("Hello!") = %v, want equal to %v`, err, ErrInputTooLarge)
+	}
+
+	tkn.SetMaxInputBytes(0)
+	if _, err := tkn.EncodeString("Hello!"); err != nil {
+		t.Fatalf(`EncodeString("Hello!") = _, %v, want equal to nil`, err)
+	}
+}
+
+// TestDecodeTokens tests that DecodeTokens returns the vocabulary's own
+// strings rather than copies.
+func TestDecodeTokens(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	i := []int{33155, 45, -1, 33155}
+	pieces, err := tkn.DecodeTokens(i)
+	if len(pieces) != 4 || pieces[0] != "Hello" || pieces[1] != "," || pieces[2] != "" || err != ErrUnknownToken {
+		t.Fatalf(`DecodeTokens(%v) = %q, %v, want equal to ["Hello" "," "" "Hello"], %v`, i, pieces, err, ErrUnknownToken)
+	}
+	if unsafe.StringData(pieces[0]) != unsafe.StringData(tkn.i2t[33155]) || unsafe.StringData(pieces[3]) != unsafe.StringData(pieces[0]) {
+		t.Fatalf(`DecodeTokens(%v) returned a copy of the token for 33155`, i)
+	}
+}
+
+// TestValidNextTokens tests finding the tokens that extend a prefix.
+func TestValidNextTokens(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{"a", "he", "hello", "help", "hex", "x"} {
+		tkn.AddTokenString(token, id)
+	}
+
+	for prefix, want := range map[string][]int{
+		"h":     {1, 2, 3, 4},
+		"hel":   {2, 3},
+		"he":    {1, 2, 3, 4},
+		"hello": {2},
+		"":      {0, 1, 2, 3, 4, 5},
+	} {
+		if ids, err := tkn.ValidNextTokens([]byte(prefix)); !intSliceEquals(ids, want) || err != nil {
+			t.Fatalf(`ValidNextTokens(%q) = %v, %v, want equal to %v`, prefix, ids, err, want)
+		}
+	}
+
+	if ids, err := tkn.ValidNextTokens([]byte("hz")); ids != nil || err != ErrCannotTokenize {
+		t.Fatalf(`ValidNextTokens("hz") = %v, %v, want equal to nil, %v`, ids, err, ErrCannotTokenize)
+	}
+}
+
+// TestNewTokenizerFromReaderMaxID tests that a restricted load omits tokens
+// with higher IDs.
+func TestNewTokenizerFromReaderMaxID(t *testing.T) {
+	if rwkvVocab20230424 == nil {
+		t.Skip("built without the embedded World vocabulary")
+	}
+
+	tkn, err := NewTokenizerFromReaderMaxID(bytes.NewReader(rwkvVocab20230424), 1000)
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReaderMaxID(_, 1000) = _, %v`, err)
+	}
+	if min, max := tkn.IDRange(); min != 1 || max != 1000 {
+		t.Fatalf(`IDRange() = %d, %d, want equal to 1, 1000`, min, max)
+	}
+	if tokens, err := tkn.EncodeString("Hello"); len(tokens) < 2 || err != nil {
+		t.Fatalf(`EncodeString("Hello") = %v, %v, want more than one token`, tokens, err)
+	}
+
+	vocab := "1 'a' 1\n2 'b' 1\n3 'c' 1\n4 'ab' 2\n"
+	tkn, err = NewTokenizerFromReaderMaxID(strings.NewReader(vocab), 2)
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReaderMaxID(_, 2) = _, %v`, err)
+	}
+	if tokens, err := tkn.EncodeString("abc"); !intSliceEquals(tokens, []int{1, 2}) || err != ErrCannotTokenize {
+		t.Fatalf(`EncodeString("abc") = %v, %v, want equal to [1 2], %v`, tokens, err, ErrCannotTokenize)
+	}
+}
+
+// TestNewTokenizerFromReaderProgress tests that the progress callback is
+// called after every given number of entries.
+func TestNewTokenizerFromReaderProgress(t *testing.T) {
+	if tkn, err := NewTokenizerFromReaderProgress(strings.NewReader("1 'a' 1\n"), 0, func(int) {}); tkn != nil || err != ErrNonPositiveCount {
+		t.Fatalf(`NewTokenizerFromReaderProgress(_, 0) = %p, %v, want equal to nil, %v`, tkn, err, ErrNonPositiveCount)
+	}
+
+	if rwkvVocab20230424 == nil {
+		t.Skip("built without the embedded World vocabulary")
+	}
+
+	var calls []int
+	_, err := NewTokenizerFromReaderProgress(bytes.NewReader(rwkvVocab20230424), 10000, func(entries int) {
+		calls = append(calls, entries)
+	})
+	if want := []int{10000, 20000, 30000, 40000, 50000, 60000}; !intSliceEquals(calls, want) || err != nil {
+		t.Fatalf(`NewTokenizerFromReaderProgress(_, 10000) called back with %v, %v, want equal to %v`, calls, err, want)
+	}
+}
+
+// TestRejectReplacementChar tests that U+FFFD is encoded by default and
+// rejected when enabled.
+func TestRejectReplacementChar(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	s := "caf\uFFFD au lait"
+
+	want, err := tkn.EncodeString(s)
+	if err != nil {
+		t.Fatalf(`EncodeString(%q) = _, %v, want equal to nil`, s, err)
+	}
+	if x, _ := tkn.DecodeToString(want); x != s {
+		t.Fatalf(`DecodeToString(%v) = %q, want equal to %q`, want, x, s)
+	}
+
+	tkn.SetRejectReplacementChar(true)
+	if tokens, err := tkn.EncodeString(s); tokens != nil || err != ErrReplacementChar {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to nil, %v`, s, tokens, err, ErrReplacementChar)
+	}
+	if _, err := tkn.EncodeString("\xff"); err != nil {
+		t.Fatalf(`EncodeString("\xff") = _, %v, want equal to nil`, err)
+	}
+
+	tkn.SetRejectReplacementChar(false)
+	if tokens, err := tkn.EncodeString(s); !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, s, tokens, err, want)
+	}
+}
+
+// TestEncodePieces tests that the pieces are subslices of the input that
+// match the tokens and concatenate to it.
+func TestEncodePieces(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+	data := []byte("Hello, こんにちは世界! 😀")
+
+	tokens, _ := tkn.Encode(data)
+	pieces, err := tkn.EncodePieces(data)
+	if len(pieces) != len(tokens) || err != nil {
+		t.Fatalf(`EncodePieces(%q) = %q, %v, want %d pieces`, data, pieces, err, len(tokens))
+	}
+
+	n := 0
+	for i, piece := range pieces {
+		if token, _ := tkn.IDToToken(tokens[i]); string(piece) != token {
+			t.Fatalf(`EncodePieces(%q)[%d] = %q, want equal to %q`, data, i, piece, token)
+		}
+		if &piece[0] != &data[n] {
+			t.Fatalf(`EncodePieces(%q)[%d] is not a subslice of the input at %d`, data, i, n)
+		}
+		n += len(piece)
+	}
+	if n != len(data) {
+		t.Fatalf(`EncodePieces(%q) covers %d bytes, want equal to %d`, data, n, len(data))
+	}
+
+	tkn = NewTokenizer()
+	tkn.AddTokenString("ab", 1)
+	tkn.SetEncodeUnknownID(0)
+	data = []byte("ab\xe4\xb8ab")
+	pieces, err = tkn.EncodePieces(data)
+	want := []string{"ab", "\xe4", "\xb8", "ab"}
+	if len(pieces) != len(want) || err != nil {
+		t.Fatalf(`EncodePieces(%q) = %q, %v, want equal to %q`, data, pieces, err, want)
+	}
+	for i := range want {
+		if string(pieces[i]) != want[i] {
+			t.Fatalf(`EncodePieces(%q) = %q, want equal to %q`, data, pieces, want)
+		}
+	}
+}
+
+// TestVocabContinuation tests reading entries wrapped across lines.
+func TestVocabContinuation(t *testing.T) {
+	vocab := "1 'hello, \\\n world' 13\n" +
+		"2 'a\\\n\\\nb' 2\n" +
+		"# comment \\\n" +
+		"3 'c\\\\' 2\n"
+	tkn, err := NewTokenizerFromReader(strings.NewReader(vocab))
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReader() = %v`, err)
+	}
+	for id, token := range map[int]string{1: "hello,  world", 2: "ab", 3: `c\`} {
+		if x, err := tkn.IDToToken(id); x != token || err != nil {
+			t.Fatalf(`IDToToken(%d) = %q, %v, want equal to %q`, id, x, err, token)
+		}
+	}
+
+	if _, err := NewTokenizerFromReader(strings.NewReader("1 'abc\\\n")); err != ErrMalformedVocabulary {
+		t.Fatalf(`NewTokenizerFromReader() = _, %v, want %v`, err, ErrMalformedVocabulary)
+	}
+}
+
+// TestNewWorldTokenizerSafe tests that loading errors are returned rather
+// than causing a panic.
+func TestNewWorldTokenizerSafe(t *testing.T) {
+	if rwkvVocab20230424 != nil {
+		if tkn, err := NewWorldTokenizerSafe(); tkn == nil || err != nil {
+			t.Fatalf(`NewWorldTokenizerSafe() = %p, %v, want a Tokenizer`, tkn, err)
+		}
+	}
+
+	for vocab, want := range map[string]error{
+		"1 'a' 1\n2 'b\n":    ErrMalformedVocabulary,
+		"1 'a' 1\n2 'a' 1\n": ErrSelfTestFailed,
+	} {
+		if tkn, err := loadWorldTokenizer(strings.NewReader(vocab)); tkn != nil || !errors.Is(err, want) {
+			t.Fatalf(`loadWorldTokenizer(%q) = %p, %v, want equal to nil, %v`, vocab, tkn, err, want)
+		}
+	}
+}
+
+// TestSetFallback tests encoding and decoding with a fallback vocabulary.
+func TestSetFallback(t *testing.T) {
+	world := newWorldTokenizer(t)
+
+	tkn := NewTokenizer()
+	tkn.AddTokenString("foo", 0)
+	tkn.AddTokenString("bar", 1)
+	tkn.ReserveIDs(2)
+	tkn.SetFallback(world)
+	if offset := tkn.FallbackOffset(); offset != 3 {
+		t.Fatalf(`FallbackOffset() = %d, want equal to 3`, offset)
+	}
+
+	// The fallback's longest match is used, even where it overlaps a
+	// token of the primary vocabulary.
+	bar, _ := world.TokenToID(" bar")
+	hello, _ := world.TokenToID("Hello")
+	want := []int{0, bar + 3, hello + 3, 0}
+	text := "foo barHellofoo"
+	if tokens, err := tkn.EncodeString(text); !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, tokens, err, want)
+	}
+	if x, err := tkn.DecodeToString(want); x != text || err != nil {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to %q`, want, x, err, text)
+	}
+
+	pieces, _ := tkn.EncodePieces([]byte(text))
+	if len(pieces) != 4 || string(pieces[1]) != " bar" {
+		t.Fatalf(`EncodePieces(%q) = %q, want 4 pieces`, text, pieces)
+	}
+
+	// Fallbacks can be chained, each shifting IDs further.
+	top := NewTokenizer()
+	top.AddTokenString("baz", 0)
+	top.SetFallback(tkn)
+	want = []int{0, 0 + 1, bar + 3 + 1}
+	if tokens, err := top.EncodeString("bazfoo bar"); !intSliceEquals(tokens, want) || err != nil {
+		t.Fatalf(`EncodeString("bazfoo bar") = %v, %v, want equal to %v`, tokens, err, want)
+	}
+	if x, err := top.DecodeToString(want); x != "bazfoo bar" || err != nil {
+		t.Fatalf(`DecodeToString(%v) = %q, %v, want equal to "bazfoo bar"`, want, x, err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf(`SetFallback() with a cycle did not panic`)
+			}
+		}()
+		tkn.SetFallback(top)
+	}()
+
+	tkn.SetFallback(nil)
+	if _, err := tkn.EncodeString(text); err != ErrCannotTokenize {
+		t.Fatalf(`EncodeString(%q) = _, %v, want %v`, text, err, ErrCannotTokenize)
+	}
+}
+
+// TestFallbackHelpers tests that the helpers taking token IDs accept the IDs
+// of the fallback tokenizer that Encode produces.
+func TestFallbackHelpers(t *testing.T) {
+	tkn := NewTokenizer()
+	tkn.AddTokenString("a", 1)
+	tkn.SetFallback(newWorldTokenizer(t))
+
+	text := "ab. Cd. "
+	tokens, err := tkn.EncodeString(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i, ok := tkn.ValidateIDs(tokens); !ok {
+		t.Fatalf(`ValidateIDs(%v) = %d, false, want equal to -1, true`, tokens, i)
+	}
+	if x, err := tkn.Recombine(tokens); !intSliceEquals(x, tokens) || err != nil {
+		t.Fatalf(`Recombine(%v) = %v, %v, want equal to %v`, tokens, x, err, tokens)
+	}
+	if chunks, err := tkn.SplitSentences(tokens); len(chunks) != 2 || err != nil {
+		t.Fatalf(`SplitSentences(%v) = %v, %v, want 2 chunks`, tokens, chunks, err)
+	}
+	want, _ := tkn.EncodeString(text + "Ef")
+	if x, err := tkn.HealAndEncode(tokens, []byte("Ef")); !intSliceEquals(x, want) || err != nil {
+		t.Fatalf(`HealAndEncode(%v, "Ef") = %v, %v, want equal to %v`, tokens, x, err, want)
+	}
+
+	var b strings.Builder
+	for _, id := range tokens {
+		token, err := tkn.IDToToken(id)
+		if err != nil {
+			t.Fatalf(`IDToToken(%d) = _, %v`, id, err)
+		}
+		b.WriteString(token)
+		if kind, err := tkn.TokenKind(id); kind != KindText && kind != KindByte || err != nil {
+			t.Fatalf(`TokenKind(%d) = %v, %v, want equal to text or byte`, id, kind, err)
+		}
+		if !tkn.IsCompleteUTF8(id) {
+			t.Fatalf(`IsCompleteUTF8(%d) = false, want equal to true`, id)
+		}
+	}
+	if b.String() != text {
+		t.Fatalf(`IDToToken() of %v = %q, want equal to %q`, tokens, b.String(), text)
+	}
+
+	// EncodeAvoiding falls back where the only match is forbidden.
+	forbidden := map[int]bool{1: true}
+	x, err := tkn.EncodeAvoiding([]byte(text), forbidden)
+	if err != nil {
+		t.Fatalf(`EncodeAvoiding(%q, %v) = %v, %v`, text, forbidden, x, err)
+	}
+	if s, _ := tkn.DecodeToString(x); s != text || x[0] == 1 {
+		t.Fatalf(`EncodeAvoiding(%q, %v) = %v, decoding to %q`, text, forbidden, x, s)
+	}
+}
+
+// TestReadFrom tests that loading with ReadFrom matches
+// NewTokenizerFromReader, and that it adds to the existing vocabulary.
+func TestReadFrom(t *testing.T) {
+	base, overlay := "1 'a' 1\n2 'b' 1\n# comment\n3 'ab' 2\n", "3 'ba' 2\n4 b'\\xff' 1\n"
+
+	want, err := NewTokenizerFromReader(strings.NewReader(base + overlay))
+	if err != nil {
+		t.Fatalf(`NewTokenizerFromReader() = _, %v`, err)
+	}
+
+	tkn := NewTokenizer()
+	for _, vocab := range []string{base, overlay} {
+		if n, err := tkn.ReadFrom(strings.NewReader(vocab)); n != int64(len(vocab)) || err != nil {
+			t.Fatalf(`ReadFrom(%q) = %d, %v, want equal to %d`, vocab, n, err, len(vocab))
+		}
+	}
+	if !trieEquals(tkn.trie, want.trie) || tkn.VocabHash() != want.VocabHash() {
+		t.Fatalf(`ReadFrom() gave a different vocabulary from NewTokenizerFromReader()`)
+	}
+
+	var _ io.ReaderFrom = tkn
+
+	// Entries before an error are kept and can be encoded.
+	if _, err := tkn.ReadFrom(strings.NewReader("5 'ca' 2\n6 'c\n")); err != ErrMalformedVocabulary {
+		t.Fatalf(`ReadFrom() = _, %v, want %v`, err, ErrMalformedVocabulary)
+	}
+	if x, err := tkn.EncodeString("caba"); !intSliceEquals(x, []int{5, 3}) || err != nil {
+		t.Fatalf(`EncodeString("caba") = %v, %v, want equal to [5 3]`, x, err)
+	}
+}
+
+// TestLoadLines tests loading a vocabulary section of a larger file that
+// ends at a sentinel line.
+func TestLoadLines(t *testing.T) {
+	config := "name = test\n[vocab]\n1 'a' 1\n2 'b' 1\n3 'ab\\\n' 2\n[end]\nlayers = 2\n"
+	sc := bufio.NewScanner(strings.NewReader(config))
+	for sc.Scan() && sc.Text() != "[vocab]" {
+	}
+
+	tkn := NewTokenizer()
+	err := tkn.LoadLines(func() (string, bool) {
+		if !sc.Scan() || sc.Text() == "[end]" {
+			return "", false
+		}
+		return sc.Text(), true
+	})
+	if err != nil {
+		t.Fatalf(`LoadLines() = %v`, err)
+	}
+	if x, err := tkn.EncodeString("abba"); !intSliceEquals(x, []int{3, 2, 1}) || err != nil {
+		t.Fatalf(`EncodeString("abba") = %v, %v, want equal to [3 2 1]`, x, err)
+	}
+	if !sc.Scan() || sc.Text() != "layers = 2" {
+		t.Fatalf(`LoadLines() consumed the line after the sentinel`)
+	}
+
+	lines := []string{"4 'c' 1", "5 'd\\"}
+	err = tkn.LoadLines(func() (string, bool) {
+		if len(lines) == 0 {
+			return "", false
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, true
+	})
+	if err != ErrMalformedVocabulary {
+		t.Fatalf(`LoadLines() = %v, want %v`, err, ErrMalformedVocabulary)
+	}
+	if x, err := tkn.EncodeString("cab"); !intSliceEquals(x, []int{4, 3}) || err != nil {
+		t.Fatalf(`EncodeString("cab") = %v, %v, want equal to [4 3]`, x, err)
+	}
+
+	// A reader's last line is loaded even without a line break.
+	tkn, err = NewTokenizerFromReader(strings.NewReader("1 'a' 1\n2 'b' 1"))
+	if x, _ := tkn.EncodeString("b"); err != nil || !intSliceEquals(x, []int{2}) {
+		t.Fatalf(`EncodeString("b") = %v, %v, want equal to [2]`, x, err)
+	}
+}
+
+// TestDecodeColored tests that each token is wrapped in its own color, with
+// non-printable characters escaped.
+func TestDecodeColored(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{"Hi", " there", "\n", "\xe4", "é"} {
+		tkn.AddTokenString(token, id)
+	}
+
+	tokens := []int{0, 1, 2, 3, 4}
+	x, err := tkn.DecodeColored(tokens)
+	if err != nil {
+		t.Fatalf(`DecodeColored(%v) = _, %v`, tokens, err)
+	}
+	if n := strings.Count(x, ansiReset); n != len(tokens) {
+		t.Fatalf(`DecodeColored(%v) has %d resets, want equal to %d`, tokens, n, len(tokens))
+	}
+	want := "\x1b[46m\x1b[30mHi\x1b[0m\x1b[43m\x1b[30m there\x1b[0m\x1b[46m\x1b[30m\\n\x1b[0m" +
+		"\x1b[43m\x1b[30m\\xe4\x1b[0m\x1b[46m\x1b[30mé\x1b[0m"
+	if x != want {
+		t.Fatalf(`DecodeColored(%v) = %q, want equal to %q`, tokens, x, want)
+	}
+
+	if _, err := tkn.DecodeColored([]int{0, 9}); err != ErrUnknownToken {
+		t.Fatalf(`DecodeColored([0 9]) = _, %v, want %v`, err, ErrUnknownToken)
+	}
+}
+
+// TestEncodePrefix tests detecting whether more input could change the
+// final tokens.
+func TestEncodePrefix(t *testing.T) {
+	tkn := NewTokenizer()
+	for id, token := range []string{"a", "b", "c", "x", "abc"} {
+		tkn.AddTokenString(token, id)
+	}
+
+	for _, c := range []struct {
+		in     string
+		want   []int
+		extend bool
+	}{
+		{"", []int{}, false},
+		{"xa", []int{3, 0}, true},
+		{"ab", []int{0, 1}, true},
+		{"abc", []int{4}, false},
+		{"cb", []int{2, 1}, false},
+		{"abcab", []int{4, 0, 1}, true},
+	} {
+		tokens, extend, err := tkn.EncodePrefix([]byte(c.in))
+		if !intSliceEquals(tokens, c.want) || extend != c.extend || err != nil {
+			t.Fatalf(`EncodePrefix(%q) = %v, %t, %v, want equal to %v, %t`, c.in, tokens, extend, err, c.want, c.extend)
+		}
+	}
+
+	// A token of the fallback vocabulary could extend the input too.
+	fallback := NewTokenizer()
+	for id, token := range []string{"H", "e", "l", "Hello"} {
+		fallback.AddTokenString(token, id)
+	}
+	layered := NewTokenizer()
+	layered.AddTokenString("a", 0)
+	layered.SetFallback(fallback)
+	if tokens, extend, err := layered.EncodePrefix([]byte("aHel")); !intSliceEquals(tokens, []int{0, 1, 2, 3}) || !extend || err != nil {
+		t.Fatalf(`EncodePrefix("aHel") = %v, %t, %v, want equal to [0 1 2 3], true`, tokens, extend, err)
+	}
+
+	// No token longer than the limit is matched, so none can be extended.
+	tkn.SetMaxMatchLen(1)
+	if tokens, extend, err := tkn.EncodePrefix([]byte("xa")); !intSliceEquals(tokens, []int{3, 0}) || extend || err != nil {
+		t.Fatalf(`EncodePrefix("xa") = %v, %t, %v, want equal to [3 0], false`, tokens, extend, err)
+	}
+}
+
+// TestEncodeUntil tests encoding up to a stop sequence.
+func TestEncodeUntil(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	hello, _ := tkn.EncodeString("Hello, world!")
+	all, _ := tkn.EncodeString("Hello, world!\n\nUser: Hi")
+	for _, c := range []struct {
+		text, stop string
+		want       []int
+		found      bool
+	}{
+		{"Hello, world!\n\nUser: Hi", "\n\nUser:", hello, true},
+		{"Hello, world!\n\nUser: Hi", "\n\nAssistant:", all, false},
+		{"Hello, world!", "", []int{}, true},
+	} {
+		tokens, found, err := tkn.EncodeUntil(c.text, c.stop)
+		if !intSliceEquals(tokens, c.want) || found != c.found || err != nil {
+			t.Fatalf(`EncodeUntil(%q, %q) = %v, %t, %v, want equal to %v, %t`, c.text, c.stop, tokens, found, err, c.want, c.found)
+		}
+	}
+
+	// "ab" would be one token, but must not extend into the stop sequence.
+	tkn = NewTokenizer()
+	for id, token := range []string{"a", "b", "ab"} {
+		tkn.AddTokenString(token, id)
+	}
+	if tokens, found, err := tkn.EncodeUntil("aabab", "bab"); !intSliceEquals(tokens, []int{0, 0}) || !found || err != nil {
+		t.Fatalf(`EncodeUntil("aabab", "bab") = %v, %t, %v, want equal to [0 0], true`, tokens, found, err)
+	}
+}
@@ -2,13 +2,21 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ronsor/rwkv-tokenizer-go"
@@ -18,8 +26,19 @@ var (
 	inputPath      = flag.String("input", "wikipedia_simple.jsonl", "Input data file")
 	inputFormat    = flag.String("input-format", "json", "Input data format (json, nullsep)")
 	inputTextField = flag.String("input-field", "text", "Text field key for JSON format")
+	maxDocBytes    = flag.Int("max-doc-bytes", 0, "Skip documents (or JSON lines) larger than this many bytes (0 for no limit)")
+	vocabPath      = flag.String("vocab", "", "Vocabulary file (default: embedded RWKV World vocabulary)")
+	skipEmpty      = flag.Bool("skip-empty", false, "Skip documents that are empty or contain only whitespace")
 
 	statsInterval = flag.Duration("stats-interval", 5*time.Second, "Interval for printing current stats")
+	prefetch      = flag.Int("prefetch", 64, "Number of documents to read ahead of the tokenizer")
+	jsonOutput    = flag.Bool("json", false, "Print only the final stats, as a JSON object")
+	outputMode    = flag.String("output", "stats", "Output mode (stats, conll)")
+	shardTokens   = flag.Int("shard-tokens", 0, "Also write the tokens to shards of this many tokens each (0 to disable)")
+	compareMode   = flag.String("compare", "", "Also encode with another implementation and compare (naive)")
+	outPrefix     = flag.String("out-prefix", "shard", "Path prefix for token shards, which are named <prefix>-00000.bin and so on")
+	dirPath       = flag.String("dir", "", "Count the tokens of every file under this directory instead of reading -input")
+	dirWorkers    = flag.Int("dir-workers", runtime.GOMAXPROCS(0), "Number of files to encode concurrently with -dir")
 )
 
 var (
@@ -28,11 +47,52 @@ var (
 		bytes  int64
 		start  time.Time
 		end    time.Time
+
+		// Only used with -compare.
+		trieTime    time.Duration
+		naiveTokens int64
+		naiveTime   time.Duration
 	}
 
 	quitFlag bool
 )
 
+var errDocTooLarge = errors.New("document too large")
+
+// readDoc reads from br up to and including delim, like ReadBytes. If
+// maxBytes is positive and the result would be longer, the rest of the
+// document is discarded without being buffered and errDocTooLarge is
+// returned instead.
+func readDoc(br *bufio.Reader, delim byte, maxBytes int) ([]byte, error) {
+	var doc []byte
+	tooLarge := false
+	for {
+		chunk, err := br.ReadSlice(delim)
+		if !tooLarge {
+			if maxBytes > 0 && len(doc)+len(chunk) > maxBytes {
+				tooLarge, doc = true, nil
+			} else {
+				doc = append(doc, chunk...)
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return doc, err
+		} else if tooLarge {
+			return nil, errDocTooLarge
+		}
+		return doc, nil
+	}
+}
+
+// isBlankDoc reports whether doc is empty or contains only whitespace,
+// ignoring a trailing document separator.
+func isBlankDoc(doc string) bool {
+	return strings.TrimSpace(strings.TrimSuffix(doc, "\x00")) == ""
+}
+
 func readInputInner(out chan string) {
 	switch *inputFormat {
 	case "nullsep":
@@ -44,14 +104,20 @@ func readInputInner(out chan string) {
 
 		bf := bufio.NewReader(f)
 		for {
-			doc, err := bf.ReadString('\x00')
+			doc, err := readDoc(bf, '\x00', *maxDocBytes)
 			if err == io.EOF {
 				break
+			} else if err == errDocTooLarge {
+				log.Println("skipping document larger than", *maxDocBytes, "bytes")
+				continue
 			} else if err != nil {
 				log.Println("failed to read data file:", err)
 				break
 			}
-			out <- doc
+			if *skipEmpty && isBlankDoc(string(doc)) {
+				continue
+			}
+			out <- string(doc)
 		}
 	case "json":
 		var m map[string]string
@@ -64,9 +130,12 @@ func readInputInner(out chan string) {
 
 		bf := bufio.NewReader(f)
 		for {
-			line, err := bf.ReadBytes('\n')
+			line, err := readDoc(bf, '\n', *maxDocBytes)
 			if err == io.EOF {
 				break
+			} else if err == errDocTooLarge {
+				log.Println("skipping JSON line larger than", *maxDocBytes, "bytes")
+				continue
 			} else if err != nil {
 				log.Println("failed to read data file:", err)
 				break
@@ -81,6 +150,9 @@ func readInputInner(out chan string) {
 				log.Println("missing text field key")
 				break
 			}
+			if *skipEmpty && isBlankDoc(doc) {
+				continue
+			}
 			out <- doc
 		}
 	}
@@ -89,7 +161,7 @@ func readInputInner(out chan string) {
 }
 
 func readInput() chan string {
-	ch := make(chan string)
+	ch := make(chan string, max(*prefetch, 0))
 	go readInputInner(ch)
 	return ch
 }
@@ -112,6 +184,270 @@ func printStats(full bool) {
 	}
 }
 
+func printJSONStats() {
+	now := time.Now()
+	if !stats.end.IsZero() {
+		now = stats.end
+	}
+	timeDiff := now.Sub(stats.start).Seconds()
+
+	out := struct {
+		Tokens        int64   `json:"tokens"`
+		Bytes         int64   `json:"bytes"`
+		ElapsedSec    float64 `json:"elapsed_sec"`
+		BytesPerToken float64 `json:"bytes_per_token"`
+		TokensPerSec  float64 `json:"tokens_per_sec"`
+		BytesPerSec   float64 `json:"bytes_per_sec"`
+
+		TrieElapsedSec  float64 `json:"trie_elapsed_sec,omitempty"`
+		NaiveTokens     int64   `json:"naive_tokens,omitempty"`
+		NaiveElapsedSec float64 `json:"naive_elapsed_sec,omitempty"`
+	}{
+		Tokens:     stats.tokens,
+		Bytes:      stats.bytes,
+		ElapsedSec: timeDiff,
+	}
+	if stats.tokens > 0 {
+		out.BytesPerToken = float64(stats.bytes) / float64(stats.tokens)
+	}
+	if *compareMode != "" {
+		out.TrieElapsedSec = stats.trieTime.Seconds()
+		out.NaiveTokens = stats.naiveTokens
+		out.NaiveElapsedSec = stats.naiveTime.Seconds()
+	}
+	if timeDiff > 0 {
+		out.TokensPerSec = float64(stats.tokens) / timeDiff
+		out.BytesPerSec = float64(stats.bytes) / timeDiff
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+		log.Println("failed to write stats:", err)
+	}
+}
+
+// conllLiteral escapes a token so that it can be printed on a single line
+// without ambiguity, even if it contains whitespace or invalid UTF-8.
+func conllLiteral(token string) string {
+	q := strconv.Quote(token)
+	return q[1 : len(q)-1]
+}
+
+// writeCoNLL writes one line per token of doc, consisting of the escaped
+// token literal and the token ID separated by a tab, followed by a blank
+// line.
+func writeCoNLL(w io.Writer, tokenizer *rwkvtkn.Tokenizer, tokens []int) error {
+	for _, id := range tokens {
+		token, err := tokenizer.IDToToken(id)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%d\n", conllLiteral(token), id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// naiveTokenizer is a greedy longest-match tokenizer backed by a map, used to
+// compare against the trie. At each position, it looks up every possible
+// token length from the longest down.
+type naiveTokenizer struct {
+	vocab  map[string]int
+	maxLen int
+}
+
+func newNaiveTokenizer(tokenizer *rwkvtkn.Tokenizer) *naiveTokenizer {
+	n := &naiveTokenizer{vocab: make(map[string]int)}
+	first, last := tokenizer.IDRange()
+	for id := first; id <= last; id++ {
+		token, err := tokenizer.IDToToken(id)
+		if err != nil {
+			continue
+		}
+		if canonical, _ := tokenizer.TokenToID(token); canonical == id {
+			n.vocab[token] = id
+		}
+		n.maxLen = max(n.maxLen, len(token))
+	}
+	return n
+}
+
+func (n *naiveTokenizer) EncodeString(text string) ([]int, error) {
+	var tokens []int
+	for i := 0; i < len(text); {
+		l := min(n.maxLen, len(text)-i)
+		for ; l > 0; l-- {
+			if id, ok := n.vocab[text[i:i+l]]; ok {
+				tokens = append(tokens, id)
+				break
+			}
+		}
+		if l == 0 {
+			return tokens, rwkvtkn.ErrCannotTokenize
+		}
+		i += l
+	}
+	return tokens, nil
+}
+
+// printComparison prints how the trie compares with the other
+// implementation.
+func printComparison() {
+	fmt.Printf(
+		"\n--- compared with %s ---\nTrie sec:    %10.04f\n%-12s %10.04f\nSpeedup:     %10.02fx\n",
+		*compareMode,
+		stats.trieTime.Seconds(),
+		*compareMode+" sec:",
+		stats.naiveTime.Seconds(),
+		stats.naiveTime.Seconds()/stats.trieTime.Seconds(),
+	)
+}
+
+// shardWriter writes a token stream to files of a fixed number of tokens
+// each, packing every token ID as a 4-byte little-endian integer, as read by
+// DecodePacked with a width of 4. Only the last shard may be shorter.
+type shardWriter struct {
+	prefix string
+	size   int
+	index  int
+	buf    []byte
+}
+
+func newShardWriter(prefix string, size int) *shardWriter {
+	return &shardWriter{prefix: prefix, size: size, buf: make([]byte, 0, 4*size)}
+}
+
+// shardPath returns the path of the shard with the given index.
+func (w *shardWriter) shardPath(index int) string {
+	return fmt.Sprintf("%s-%05d.bin", w.prefix, index)
+}
+
+// Write adds tokens to the stream, writing out each shard once it is full.
+func (w *shardWriter) Write(tokens []int) error {
+	for _, id := range tokens {
+		if id < 0 || uint64(id) > math.MaxUint32 {
+			return fmt.Errorf("token ID %d does not fit in a shard", id)
+		}
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(id))
+		if len(w.buf) == 4*w.size {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close writes out the last shard, if it holds any tokens.
+func (w *shardWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *shardWriter) flush() error {
+	if err := os.WriteFile(w.shardPath(w.index), w.buf, 0o644); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// fileCount holds the number of tokens and bytes in a file.
+type fileCount struct {
+	Path   string `json:"path"`
+	Tokens int64  `json:"tokens"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// countDir encodes every regular file in the tree rooted at root, using up to
+// workers goroutines that share the tokenizer, and returns the counts for
+// each file in lexical order of their paths, which are relative to root.
+func countDir(tokenizer *rwkvtkn.Tokenizer, root string, workers int) ([]fileCount, error) {
+	var counts []fileCount
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		counts = append(counts, fileCount{Path: rel})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	indices := make(chan int)
+	errs := make([]error, len(counts))
+	for w := 0; w < max(workers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = countFile(tokenizer, filepath.Join(root, counts[i].Path), &counts[i])
+			}
+		}()
+	}
+	for i := range counts {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", counts[i].Path, err)
+		}
+	}
+	return counts, nil
+}
+
+// countFile encodes the file at path and stores its counts in c.
+func countFile(tokenizer *rwkvtkn.Tokenizer, path string, c *fileCount) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.Bytes = int64(len(data))
+	return tokenizer.EncodeFunc(data, func(int) error {
+		c.Tokens++
+		return nil
+	})
+}
+
+// printDirCounts prints the counts for each file followed by the total, or
+// a JSON object holding both with -json.
+func printDirCounts(w io.Writer, counts []fileCount) error {
+	var total fileCount
+	for _, c := range counts {
+		total.Tokens += c.Tokens
+		total.Bytes += c.Bytes
+	}
+
+	if *jsonOutput {
+		return json.NewEncoder(w).Encode(struct {
+			Files  []fileCount `json:"files"`
+			Tokens int64       `json:"tokens"`
+			Bytes  int64       `json:"bytes"`
+		}{counts, total.Tokens, total.Bytes})
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%12s %14s  %s\n", "Tokens", "Bytes", "Path")
+	for _, c := range counts {
+		fmt.Fprintf(bw, "%12d %14d  %s\n", c.Tokens, c.Bytes, c.Path)
+	}
+	fmt.Fprintf(bw, "%12d %14d  (total, %d files)\n", total.Tokens, total.Bytes, len(counts))
+	return bw.Flush()
+}
+
 func statReporter() {
 	i := 0
 	for {
@@ -126,6 +462,13 @@ func signalHandler(ch chan os.Signal) {
 	for sig := range ch {
 		switch sig {
 		case os.Interrupt:
+			if *outputMode == "conll" {
+				log.Fatal("interrupted")
+			}
+			if *jsonOutput {
+				printJSONStats()
+				log.Fatal("interrupted")
+			}
 			printStats(true)
 			if !quitFlag {
 				fmt.Println("*** Use ^C again to quit ***")
@@ -140,7 +483,50 @@ func signalHandler(ch chan os.Signal) {
 func main() {
 	flag.Parse()
 
-	tokenizer := rwkvtkn.NewWorldTokenizer()
+	var conll *bufio.Writer
+	switch *outputMode {
+	case "stats":
+	case "conll":
+		conll = bufio.NewWriter(os.Stdout)
+	default:
+		log.Fatal("unknown output mode: ", *outputMode)
+	}
+
+	var naive *naiveTokenizer
+
+	var shards *shardWriter
+	if *shardTokens > 0 {
+		shards = newShardWriter(*outPrefix, *shardTokens)
+	}
+
+	var tokenizer *rwkvtkn.Tokenizer
+	if *vocabPath == "" {
+		tokenizer = rwkvtkn.NewWorldTokenizer()
+	} else {
+		var err error
+		tokenizer, err = rwkvtkn.NewTokenizerFromFile(*vocabPath)
+		if err != nil {
+			log.Fatal("could not load vocabulary file: ", err)
+		}
+	}
+	if *dirPath != "" {
+		counts, err := countDir(tokenizer, *dirPath, *dirWorkers)
+		if err != nil {
+			log.Fatal("failed to count tokens: ", err)
+		}
+		if err := printDirCounts(os.Stdout, counts); err != nil {
+			log.Fatal("failed to write output: ", err)
+		}
+		return
+	}
+
+	switch *compareMode {
+	case "":
+	case "naive":
+		naive = newNaiveTokenizer(tokenizer)
+	default:
+		log.Fatal("unknown comparison: ", *compareMode)
+	}
 	dataset := readInput()
 
 	ch := make(chan os.Signal, 1)
@@ -148,18 +534,67 @@ func main() {
 	go signalHandler(ch)
 
 	stats.start = time.Now()
-	go statReporter()
+	if !*jsonOutput && conll == nil {
+		go statReporter()
+	}
 	for doc := range dataset {
+		encodeStart := time.Now()
 		tokens, err := tokenizer.EncodeString(doc)
 		if err != nil {
 			log.Fatal("tokenizer error:", err)
 		}
+		if naive != nil {
+			stats.trieTime += time.Since(encodeStart)
+
+			naiveStart := time.Now()
+			naiveTokens, err := naive.EncodeString(doc)
+			stats.naiveTime += time.Since(naiveStart)
+			if err != nil {
+				log.Fatal("naive tokenizer error:", err)
+			}
+			if len(naiveTokens) != len(tokens) {
+				log.Fatalf("naive tokenizer produced %d tokens, trie produced %d", len(naiveTokens), len(tokens))
+			}
+			stats.naiveTokens += int64(len(naiveTokens))
+		}
 		stats.tokens += int64(len(tokens))
 		stats.bytes += int64(len(doc))
+
+		if conll != nil {
+			if err := writeCoNLL(conll, tokenizer, tokens); err != nil {
+				log.Fatal("failed to write output:", err)
+			}
+		}
+		if shards != nil {
+			if err := shards.Write(tokens); err != nil {
+				log.Fatal("failed to write shard:", err)
+			}
+		}
 	}
 	stats.end = time.Now()
 
+	if shards != nil {
+		if err := shards.Close(); err != nil {
+			log.Fatal("failed to write shard:", err)
+		}
+	}
+
+	if conll != nil {
+		if err := conll.Flush(); err != nil {
+			log.Fatal("failed to write output:", err)
+		}
+		return
+	}
+
+	if *jsonOutput {
+		printJSONStats()
+		return
+	}
+
 	fmt.Println("\n--- final stats ---")
 	printStats(true)
 	fmt.Println("\n--- ----------- ---")
+	if naive != nil {
+		printComparison()
+	}
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ronsor/rwkv-tokenizer-go"
+)
+
+// TestReadDocMaxBytes tests that an oversized line is skipped without
+// affecting the lines around it.
+func TestReadDocMaxBytes(t *testing.T) {
+	input := "short\n" + strings.Repeat("x", 10000) + "\nshort again\n"
+	br := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	want := []struct {
+		doc string
+		err error
+	}{
+		{"short\n", nil},
+		{"", errDocTooLarge},
+		{"short again\n", nil},
+		{"", io.EOF},
+	}
+	for _, w := range want {
+		doc, err := readDoc(br, '\n', 100)
+		if string(doc) != w.doc || err != w.err {
+			t.Fatalf(`readDoc() = %q, %v, want equal to %q, %v`, doc, err, w.doc, w.err)
+		}
+	}
+}
+
+// TestWriteCoNLL tests the CoNLL output for a small document, including
+// tokens that need escaping.
+func TestWriteCoNLL(t *testing.T) {
+	tokenizer := rwkvtkn.NewTokenizer()
+	tokenizer.AddTokenString("Hi", 1)
+	tokenizer.AddTokenString("\t", 2)
+	tokenizer.AddToken([]byte{0xe4}, 3)
+	tokenizer.AddTokenString("\"x\"", 4)
+
+	tokens, err := tokenizer.EncodeString("Hi\t\xe4\"x\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := writeCoNLL(&b, tokenizer, tokens); err != nil {
+		t.Fatalf(`writeCoNLL() = %v`, err)
+	}
+	want := "Hi\t1\n\\t\t2\n\\xe4\t3\n\\\"x\\\"\t4\n\n"
+	if b.String() != want {
+		t.Fatalf(`writeCoNLL() wrote %q, want %q`, b.String(), want)
+	}
+}
+
+// TestIsBlankDoc tests detecting documents that -skip-empty drops.
+func TestIsBlankDoc(t *testing.T) {
+	for doc, want := range map[string]bool{
+		"":         true,
+		" \n\t":    true,
+		"\x00":     true,
+		"  \x00":   true,
+		"a":        false,
+		" a \x00":  false,
+		"\x00\x00": false,
+		"\u3000":   true,
+	} {
+		if got := isBlankDoc(doc); got != want {
+			t.Fatalf(`isBlankDoc(%q) = %v, want equal to %v`, doc, got, want)
+		}
+	}
+}
+
+// TestShardWriter tests that the shards hold the requested number of tokens
+// and concatenate back to the full token stream.
+func TestShardWriter(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "shard")
+	w := newShardWriter(prefix, 4)
+
+	var want []int
+	for _, tokens := range [][]int{{1, 2, 3}, {65529, 70000}, {}, {4, 5, 6, 7, 8, 9}} {
+		if err := w.Write(tokens); err != nil {
+			t.Fatalf(`Write(%v) = %v`, tokens, err)
+		}
+		want = append(want, tokens...)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf(`Close() = %v`, err)
+	}
+
+	var got []int
+	for i := 0; ; i++ {
+		packed, err := os.ReadFile(w.shardPath(i))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			t.Fatalf(`ReadFile(%q) = %v`, w.shardPath(i), err)
+		}
+
+		tokens, err := rwkvtkn.NewTokenizer().DecodePacked(packed, 4)
+		if err != nil {
+			t.Fatalf(`DecodePacked(%q) = %v`, w.shardPath(i), err)
+		}
+		if len(tokens) != 4 && i != len(want)/4 {
+			t.Fatalf(`shard %d holds %d tokens, want equal to 4`, i, len(tokens))
+		}
+		got = append(got, tokens...)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf(`shards hold %v, want equal to %v`, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf(`shards hold %v, want equal to %v`, got, want)
+		}
+	}
+}
+
+// TestNaiveTokenizer tests that the naive tokenizer gives the same tokens as
+// the trie.
+func TestNaiveTokenizer(t *testing.T) {
+	tokenizer, err := rwkvtkn.NewWorldTokenizerSafe()
+	if err != nil {
+		t.Skip("World vocabulary not available:", err)
+	}
+	naive := newNaiveTokenizer(tokenizer)
+
+	text := "Hello, world! Le cœur a ses raisons. こんにちは、世界！\n\n\tfunc main() {}"
+	want, _ := tokenizer.EncodeString(text)
+	tokens, err := naive.EncodeString(text)
+	if len(tokens) != len(want) || err != nil {
+		t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, tokens, err, want)
+	}
+	for i := range tokens {
+		if tokens[i] != want[i] {
+			t.Fatalf(`EncodeString(%q) = %v, %v, want equal to %v`, text, tokens, err, want)
+		}
+	}
+}
+
+// TestCountDir tests counting the tokens of a small tree of files, including
+// files in subdirectories.
+func TestCountDir(t *testing.T) {
+	tokenizer := rwkvtkn.NewTokenizer()
+	for id, token := range []string{"a", "b", " ", "ab", "\n"} {
+		tokenizer.AddTokenString(token, id)
+	}
+
+	root := t.TempDir()
+	files := map[string]string{
+		"top.txt":               "ab ab\n",
+		"empty.txt":             "",
+		"sub/one.txt":           "aaa",
+		"sub/deeper/two.txt":    "ba ab",
+		"sub/deeper/three.text": "b\nb\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []fileCount{
+		{"empty.txt", 0, 0},
+		{filepath.FromSlash("sub/deeper/three.text"), 4, 4},
+		{filepath.FromSlash("sub/deeper/two.txt"), 4, 5},
+		{filepath.FromSlash("sub/one.txt"), 3, 3},
+		{"top.txt", 4, 6},
+	}
+	for _, workers := range []int{1, 3} {
+		counts, err := countDir(tokenizer, root, workers)
+		if err != nil {
+			t.Fatalf(`countDir(%d workers) = _, %v`, workers, err)
+		}
+		if len(counts) != len(want) {
+			t.Fatalf(`countDir(%d workers) = %v, want equal to %v`, workers, counts, want)
+		}
+		for i := range want {
+			if counts[i] != want[i] {
+				t.Fatalf(`countDir(%d workers) = %v, want equal to %v`, workers, counts, want)
+			}
+		}
+	}
+
+	var b strings.Builder
+	if err := printDirCounts(&b, want); err != nil {
+		t.Fatalf(`printDirCounts() = %v`, err)
+	}
+	if !strings.HasSuffix(b.String(), "          15             18  (total, 5 files)\n") {
+		t.Fatalf(`printDirCounts() wrote %q, want the total last`, b.String())
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "sub", "bad.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := countDir(tokenizer, root, 2); !errors.Is(err, rwkvtkn.ErrCannotTokenize) {
+		t.Fatalf(`countDir() = _, %v, want %v`, err, rwkvtkn.ErrCannotTokenize)
+	}
+}
+
+// TestReadInputPrefetch tests that the documents read, and so the final
+// counts, do not depend on how far the reader prefetches.
+func TestReadInputPrefetch(t *testing.T) {
+	tokenizer := rwkvtkn.NewTokenizer()
+	for c := 0; c < 256; c++ {
+		tokenizer.AddToken([]byte{byte(c)}, c)
+	}
+	tokenizer.AddTokenString("doc", 256)
+
+	var data strings.Builder
+	for i := 0; i < 500; i++ {
+		data.WriteString(strings.Repeat("doc ", i%7) + "\x00")
+	}
+	path := filepath.Join(t.TempDir(), "docs.bin")
+	if err := os.WriteFile(path, []byte(data.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath, oldFormat, oldPrefetch := *inputPath, *inputFormat, *prefetch
+	defer func() { *inputPath, *inputFormat, *prefetch = oldPath, oldFormat, oldPrefetch }()
+	*inputPath, *inputFormat = path, "nullsep"
+
+	// count returns the number of documents, tokens and bytes read.
+	count := func(n int) (docs, tokens, bytes int) {
+		*prefetch = n
+		for doc := range readInput() {
+			x, err := tokenizer.EncodeString(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs, tokens, bytes = docs+1, tokens+len(x), bytes+len(doc)
+		}
+		return
+	}
+
+	docs, tokens, bytes := count(0)
+	if docs != 500 || bytes != data.Len() {
+		t.Fatalf(`readInput() with -prefetch 0 read %d documents, %d bytes, want equal to 500, %d`, docs, bytes, data.Len())
+	}
+	if d, x, b := count(oldPrefetch); d != docs || x != tokens || b != bytes {
+		t.Fatalf(`readInput() with -prefetch %d read %d, %d, %d, want equal to %d, %d, %d`, oldPrefetch, d, x, b, docs, tokens, bytes)
+	}
+}
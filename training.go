@@ -0,0 +1,105 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncodeSegments encodes each of the given segments separately and returns
+// the concatenated tokens, along with the index of the segment each token
+// came from. Tokens never span segment boundaries.
+func (t *Tokenizer) EncodeSegments(segments []string) (tokens []int, segmentIDs []int, err error) {
+	tokens = make([]int, 0, 32)
+	for i, segment := range segments {
+		data := t.normalizeNewlines([]byte(segment))
+		if i == 0 && t.needsPrefixSpace(data) {
+			data = append([]byte{' '}, data...)
+		}
+
+		n := len(tokens)
+		tokens, err = t.encodeAppend(tokens, data)
+		for range tokens[n:] {
+			segmentIDs = append(segmentIDs, i)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetInstructionMarkers sets the token IDs that EncodeInstruction inserts
+// before the prompt (bos) and after the response (eos). A negative ID
+// disables the corresponding marker, which is the default.
+func (t *Tokenizer) SetInstructionMarkers(bos, eos int) {
+	t.bosID, t.eosID = bos, eos
+}
+
+// EncodeInstruction encodes an instruction-tuning example, returning its
+// tokens and a loss mask of the same length. Tokens from prompt, and the
+// beginning marker if set, have a mask of 0; tokens from response, and the
+// end marker if set, have a mask of 1.
+func (t *Tokenizer) EncodeInstruction(prompt, response string) (tokens []int, lossMask []int, err error) {
+	tokens, lossMask, err = t.EncodeSegments([]string{prompt, response})
+	if err != nil {
+		return
+	}
+
+	if t.bosID >= 0 {
+		tokens = append([]int{t.bosID}, tokens...)
+		lossMask = append([]int{0}, lossMask...)
+	}
+	if t.eosID >= 0 {
+		tokens = append(tokens, t.eosID)
+		lossMask = append(lossMask, 1)
+	}
+	return
+}
+
+// ExpandTemplate replaces each {{name}} placeholder in template with
+// vars[name]. Spaces around the name are ignored, and a {{ without a
+// matching }} is kept as is. It returns an error wrapping
+// ErrUndefinedVariable if a placeholder names a variable not in vars.
+func ExpandTemplate(template string, vars map[string]string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(template, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start+2:], "}}")
+		if end < 0 {
+			break
+		}
+
+		name := strings.TrimSpace(template[start+2 : start+2+end])
+		value, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrUndefinedVariable, name)
+		}
+		b.WriteString(template[:start])
+		b.WriteString(value)
+		template = template[start+2+end+2:]
+	}
+	b.WriteString(template)
+	return b.String(), nil
+}
+
+// TemplateTokenCost returns the number of tokens that template encodes to
+// once its placeholders are expanded with ExpandTemplate, for fitting
+// templated prompts within a context window.
+func (t *Tokenizer) TemplateTokenCost(template string, vars map[string]string) (int, error) {
+	text, err := ExpandTemplate(template, vars)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = t.EncodeFunc([]byte(text), func(int) error {
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,92 @@
+package rwkvtkn
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestEncodeSegments tests that each token is tagged with its segment and
+// that tokens do not cross segment boundaries.
+func TestEncodeSegments(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	segments := []string{"User: Hello, wor", "ld!"}
+	x, y, err := tkn.EncodeSegments(segments)
+	if err != nil {
+		t.Fatalf(`EncodeSegments(%q) = %v`, segments, err)
+	}
+
+	var i, j []int
+	for k, segment := range segments {
+		z, err := tkn.EncodeString(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i = append(i, z...)
+		for range z {
+			j = append(j, k)
+		}
+	}
+	if !intSliceEquals(x, i) || !intSliceEquals(y, j) {
+		t.Fatalf(`EncodeSegments(%q) = %v, %v, want equal to %v, %v`, segments, x, y, i, j)
+	}
+}
+
+// TestEncodeInstruction tests the loss mask of an instruction example, with
+// and without markers.
+func TestEncodeInstruction(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	prompt, response := "User: Hi\n\nAssistant:", " Hello!"
+	p, _ := tkn.EncodeString(prompt)
+	r, _ := tkn.EncodeString(response)
+
+	check := func(bos, eos int) {
+		var i, m []int
+		if bos >= 0 {
+			i, m = append(i, bos), append(m, 0)
+		}
+		i = append(i, p...)
+		for range p {
+			m = append(m, 0)
+		}
+		i = append(i, r...)
+		for range r {
+			m = append(m, 1)
+		}
+		if eos >= 0 {
+			i, m = append(i, eos), append(m, 1)
+		}
+
+		tkn.SetInstructionMarkers(bos, eos)
+		x, y, err := tkn.EncodeInstruction(prompt, response)
+		if !intSliceEquals(x, i) || !intSliceEquals(y, m) || err != nil {
+			t.Fatalf(`EncodeInstruction(%q, %q) = %v, %v, %v, want equal to %v, %v`, prompt, response, x, y, err, i, m)
+		}
+	}
+	check(-1, -1)
+	check(0, 0)
+}
+
+// TestTemplateTokenCost tests counting the tokens of a template with several
+// placeholders.
+func TestTemplateTokenCost(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	template := "User: {{ question }}\n\nAssistant: {{answer}} {{answer}}{{"
+	vars := map[string]string{"question": "Hello, world!", "answer": "こんにちは"}
+	want := "User: Hello, world!\n\nAssistant: こんにちは こんにちは{{"
+
+	if text, err := ExpandTemplate(template, vars); text != want || err != nil {
+		t.Fatalf(`ExpandTemplate(%q) = %q, %v, want equal to %q`, template, text, err, want)
+	}
+
+	tokens, _ := tkn.EncodeString(want)
+	if n, err := tkn.TemplateTokenCost(template, vars); n != len(tokens) || err != nil {
+		t.Fatalf(`TemplateTokenCost(%q) = %d, %v, want equal to %d`, template, n, err, len(tokens))
+	}
+
+	if _, err := tkn.TemplateTokenCost("{{missing}}", vars); !errors.Is(err, ErrUndefinedVariable) {
+		t.Fatalf(`TemplateTokenCost("{{missing}}") = _, %v, want %v`, err, ErrUndefinedVariable)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import "sync"
+
+// The representation of a trieNode's children is selected at build time.
+// By default, each node holds a dense [256]*trieNode array, which gives the
+// fastest lookups. Building with the rwkvtkn_compact tag switches to a
+// map[byte]*trieNode, which is slower but uses far less memory.
+
+func (t *trieNode) Insert(key []byte, value int) {
+	node := t
+	for _, c := range key {
+		child := node.child(c)
+		if child == nil {
+			child = &trieNode{value: -1}
+			node.setChild(c, child)
+		}
+
+		node = child
+	}
+	node.value = value
+}
+
+func (t *trieNode) InsertString(key string, value int) {
+	t.Insert([]byte(key), value)
+}
+
+func (t *trieNode) FindLongest(data []byte, index int) (endIndex, value int) {
+	node := t
+	endIndex, value = 0, -1
+	for {
+		node = node.child(data[index])
+		if node == nil {
+			break
+		}
+		index += 1
+
+		if node.value != -1 {
+			endIndex = index
+			value = node.value
+		}
+
+		if index == len(data) {
+			break
+		}
+	}
+	return
+}
+
+// FindAll calls fn for every token that matches data starting at index, in
+// order of increasing length.
+func (t *trieNode) FindAll(data []byte, index int, fn func(endIndex, value int)) {
+	node := t
+	for index < len(data) {
+		node = node.child(data[index])
+		if node == nil {
+			break
+		}
+		index += 1
+
+		if node.value != -1 {
+			fn(index, node.value)
+		}
+	}
+}
+
+// HasPrefix reports whether key is a prefix of some path in the trie, that
+// is, whether a token could begin with key.
+func (t *trieNode) HasPrefix(key []byte) bool {
+	return t.node(key) != nil
+}
+
+// node returns the node reached by following key from t, or nil if there
+// is none.
+func (t *trieNode) node(key []byte) *trieNode {
+	node := t
+	for _, c := range key {
+		if node = node.child(c); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// eachValue calls fn for the value of the node and of each of its
+// descendants that holds a token.
+func (t *trieNode) eachValue(fn func(value int)) {
+	if t.value != -1 {
+		fn(t.value)
+	}
+	t.eachChild(func(_ byte, child *trieNode) {
+		child.eachValue(fn)
+	})
+}
+
+// hasValue reports whether the node or any of its descendants holds a token.
+func (t *trieNode) hasValue() bool {
+	if t.value != -1 {
+		return true
+	}
+	found := false
+	t.eachChild(func(_ byte, child *trieNode) {
+		found = found || child.hasValue()
+	})
+	return found
+}
+
+// canExtend reports whether key is a proper prefix of some token in the
+// trie, so that a token matching more input could begin with it.
+func (t *trieNode) canExtend(key []byte) bool {
+	node := t.node(key)
+	if node == nil {
+		return false
+	}
+	found := false
+	node.eachChild(func(_ byte, child *trieNode) {
+		found = found || child.hasValue()
+	})
+	return found
+}
+
+func (t *trieNode) Count() int {
+	n := 1
+	t.eachChild(func(_ byte, child *trieNode) {
+		n += child.Count()
+	})
+	return n
+}
+
+func (t *trieNode) MemSize() int64 {
+	n := t.nodeSize()
+	t.eachChild(func(_ byte, child *trieNode) {
+		n += child.MemSize()
+	})
+	return n
+}
+
+// buildTrie returns a trie holding every token in tokens. If parallel is
+// true, the subtrie under each first byte is built in its own goroutine;
+// since no two subtries share nodes below the root, this needs no locking
+// until they are attached. Either way, the resulting trie is the same.
+func buildTrie(tokens map[string]int, parallel bool) *trieNode {
+	root := &trieNode{value: -1}
+	if !parallel {
+		for token, id := range tokens {
+			root.InsertString(token, id)
+		}
+		return root
+	}
+
+	var groups [256]map[string]int
+	for token, id := range tokens {
+		if token == "" {
+			root.value = id
+			continue
+		}
+		g := &groups[token[0]]
+		if *g == nil {
+			*g = make(map[string]int)
+		}
+		(*g)[token[1:]] = id
+	}
+
+	var subtries [256]*trieNode
+	var wg sync.WaitGroup
+	for c := range groups {
+		if groups[c] == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			subtries[c] = buildTrie(groups[c], false)
+		}(c)
+	}
+	wg.Wait()
+
+	for c, child := range subtries {
+		if child != nil {
+			root.setChild(byte(c), child)
+		}
+	}
+	return root
+}
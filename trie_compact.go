@@ -0,0 +1,37 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+//go:build rwkvtkn_compact
+
+package rwkvtkn
+
+import "unsafe"
+
+type trieNode struct {
+	children map[byte]*trieNode
+	value    int
+}
+
+func (t *trieNode) child(c byte) *trieNode {
+	return t.children[c]
+}
+
+func (t *trieNode) setChild(c byte, child *trieNode) {
+	if t.children == nil {
+		t.children = make(map[byte]*trieNode, 1)
+	}
+	t.children[c] = child
+}
+
+func (t *trieNode) eachChild(fn func(c byte, child *trieNode)) {
+	for c, child := range t.children {
+		fn(c, child)
+	}
+}
+
+func (t *trieNode) nodeSize() int64 {
+	n := int64(unsafe.Sizeof(*t))
+	if t.children != nil {
+		n += int64(len(t.children)) * (int64(unsafe.Sizeof(byte(0))+unsafe.Sizeof(t)) + mapEntryOverhead)
+	}
+	return n
+}
@@ -0,0 +1,32 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+//go:build !rwkvtkn_compact
+
+package rwkvtkn
+
+import "unsafe"
+
+type trieNode struct {
+	children [256]*trieNode
+	value    int
+}
+
+func (t *trieNode) child(c byte) *trieNode {
+	return t.children[c]
+}
+
+func (t *trieNode) setChild(c byte, child *trieNode) {
+	t.children[c] = child
+}
+
+func (t *trieNode) eachChild(fn func(c byte, child *trieNode)) {
+	for c, child := range t.children {
+		if child != nil {
+			fn(byte(c), child)
+		}
+	}
+}
+
+func (t *trieNode) nodeSize() int64 {
+	return int64(unsafe.Sizeof(*t))
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+package rwkvtkn
+
+import "testing"
+
+// trieEquals reports whether two tries hold the same values at the same
+// paths.
+func trieEquals(a, b *trieNode) bool {
+	if a.value != b.value || a.Count() != b.Count() {
+		return false
+	}
+	equal := true
+	a.eachChild(func(c byte, child *trieNode) {
+		other := b.child(c)
+		equal = equal && other != nil && trieEquals(child, other)
+	})
+	return equal
+}
+
+// TestBuildTrie tests that building the World vocabulary trie in parallel
+// gives the same trie as inserting its tokens one by one.
+func TestBuildTrie(t *testing.T) {
+	tkn := newWorldTokenizer(t)
+
+	want := &trieNode{value: -1}
+	for id := 1; id <= 65529; id++ {
+		want.InsertString(tkn.i2t[id], id)
+	}
+
+	for _, parallel := range []bool{false, true} {
+		if got := buildTrie(tkn.t2i, parallel); !trieEquals(got, want) {
+			t.Fatalf(`buildTrie(_, %v) differs from serial insertion`, parallel)
+		}
+	}
+}
+
+func benchmarkBuildTrie(b *testing.B, parallel bool) {
+	tkn := newWorldTokenizer(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buildTrie(tkn.t2i, parallel)
+	}
+}
+
+func BenchmarkBuildTrieSerial(b *testing.B)   { benchmarkBuildTrie(b, false) }
+func BenchmarkBuildTrieParallel(b *testing.B) { benchmarkBuildTrie(b, true) }
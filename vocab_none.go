@@ -0,0 +1,9 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+//go:build rwkvtkn_novocab
+
+package rwkvtkn
+
+// rwkvVocab20230424 is nil because the rwkvtkn_novocab build tag omits the
+// embedded World vocabulary.
+var rwkvVocab20230424 []byte
@@ -0,0 +1,30 @@
+//go:build rwkvtkn_novocab
+
+package rwkvtkn
+
+import (
+	"testing"
+)
+
+// TestNoEmbeddedVocabulary tests that NewWorldTokenizer reports the missing
+// vocabulary.
+func TestNoEmbeddedVocabulary(t *testing.T) {
+	if b := WorldVocabBytes(); b != nil {
+		t.Fatalf(`WorldVocabBytes() = %d bytes, want nil`, len(b))
+	}
+
+	defer func() {
+		if r := recover(); r != ErrNoEmbeddedVocabulary.Error() {
+			t.Fatalf(`NewWorldTokenizer() panicked with %v, want %q`, r, ErrNoEmbeddedVocabulary.Error())
+		}
+	}()
+	NewWorldTokenizer()
+}
+
+// TestNoEmbeddedVocabularySafe tests that NewWorldTokenizerSafe returns
+// ErrNoEmbeddedVocabulary.
+func TestNoEmbeddedVocabularySafe(t *testing.T) {
+	if tkn, err := NewWorldTokenizerSafe(); tkn != nil || err != ErrNoEmbeddedVocabulary {
+		t.Fatalf(`NewWorldTokenizerSafe() = %p, %v, want equal to nil, %v`, tkn, err, ErrNoEmbeddedVocabulary)
+	}
+}
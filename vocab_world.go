@@ -0,0 +1,12 @@
+// Copyright (C) 2024 Ronsor Labs. Licensed under the MIT license.
+
+//go:build !rwkvtkn_novocab
+
+package rwkvtkn
+
+import (
+	_ "embed"
+)
+
+//go:embed rwkv_vocab_v20230424.txt
+var rwkvVocab20230424 []byte